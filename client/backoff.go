@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff is an exponentially growing, jittered delay between reconnect
+// attempts, so providers don't all hammer a relay that just came back
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+// next returns the delay before the next attempt, somewhere between half
+// and all of min doubled once per failed attempt, capped at max
+func (b *backoff) next() time.Duration {
+	d := b.min << b.attempt
+	if d <= 0 || d >= b.max {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
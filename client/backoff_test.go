@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max time.Duration
+	}{
+		{"second to minute", time.Second, time.Minute},
+		{"max not a power of two of min", time.Millisecond * 300, time.Second * 5},
+		{"min equals max", time.Second, time.Second},
+		{"doubling overflows", time.Hour, math.MaxInt64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &backoff{min: tt.min, max: tt.max}
+			d := tt.min
+			for attempt := 0; attempt < 70; attempt++ {
+				got := b.next()
+				if got < d/2 || got > d {
+					t.Fatalf("attempt %d: %s, want between %s and %s", attempt, got, d/2, d)
+				}
+				// the full delay doubles until it reaches max
+				if d > tt.max/2 {
+					d = tt.max
+				} else {
+					d *= 2
+				}
+			}
+
+			b.reset()
+			if got := b.next(); got < tt.min/2 || got > tt.min {
+				t.Fatalf("after reset: %s, want between %s and %s", got, tt.min/2, tt.min)
+			}
+		})
+	}
+}
+
+// Delays are spread over their range rather than all the same, so
+// providers that dropped together don't all come back together
+func TestBackoffJitter(t *testing.T) {
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		b := &backoff{min: time.Second, max: time.Minute}
+		seen[b.next()] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("20 first delays were all %v", seen)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ivynya/illm/internal"
+)
+
+// a request the provider has accepted and can still cancel
+type running struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// running requests by request key, so a cancel from the relay can abort
+// the matching ollama stream
+var (
+	runningMu sync.Mutex
+	requests  = make(map[string][]*running)
+)
+
+// start tracking a request and return the context it should run under
+func track(req *internal.Request) *running {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &running{ctx: ctx, cancel: cancel}
+
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	key := req.Key()
+	requests[key] = append(requests[key], r)
+	return r
+}
+
+// stop tracking a request once it has finished
+func untrack(req *internal.Request, r *running) {
+	r.cancel()
+
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	key := req.Key()
+	list := requests[key]
+	for i := range list {
+		if list[i] == r {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(requests, key)
+	} else {
+		requests[key] = list
+	}
+}
+
+// number of requests accepted and not yet finished
+func trackedCount() int {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	n := 0
+	for _, list := range requests {
+		n += len(list)
+	}
+	return n
+}
+
+// cancel every request with the same key as req
+func cancelRequest(req *internal.Request) {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	for _, r := range requests[req.Key()] {
+		r.cancel()
+	}
+}
+
+// cancel everything, used when the relay connection is lost
+func cancelAll() {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	for _, list := range requests {
+		for _, r := range list {
+			r.cancel()
+		}
+	}
+}
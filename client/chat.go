@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ivynya/illm/internal"
+	"github.com/ivynya/illm/ollama"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func chat(ctx context.Context, w *writer, req *internal.Request) (*llms.Generation, error) {
+	if len(req.Generate.Messages) == 0 {
+		return nil, &requestError{code: internal.ErrInvalidRequest, err: errors.New("chat needs at least one message")}
+	}
+	if len(req.Images()) > 0 {
+		err := checkMultimodal(ctx, req.Generate.Model)
+		if err != nil {
+			return nil, err
+		}
+	}
+	messages := make([]*ollama.Message, 0, len(req.Generate.Messages))
+	for _, message := range req.Generate.Messages {
+		images, err := decodeImages(message.Images)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &ollama.Message{
+			Role:    message.Role,
+			Content: message.Content,
+			Images:  images,
+		})
+	}
+
+	llmOpts, callOpts := generateOptions(req)
+	llm, err := ollama.New(append(llmOpts, ollama.WithModel(req.Generate.Model), ollama.WithServerURL(cfg.OllamaURL))...)
+	if err != nil {
+		return nil, err
+	}
+	completion, err := llm.Chat(ctx,
+		messages,
+		append(callOpts,
+			llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+				observeChunk(chunk)
+				resp, err := encodeRequest(req, "response", string(chunk))
+				if err != nil {
+					return err
+				}
+				return w.Write(resp)
+			}),
+		)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return completion, nil
+}
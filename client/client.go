@@ -1,111 +1,205 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/ivynya/illm/internal"
 )
 
-// global environment variables
-var (
-	auth        = os.Getenv("AUTH")
-	identifier  = os.Getenv("IDENTIFIER")
-	illm_scheme = os.Getenv("ILLM_SCHEME")
-	illm_host   = os.Getenv("ILLM_HOST")
-	illm_path   = os.Getenv("ILLM_PATH")
-	ollama_url  = os.Getenv("OLLAMA_URL")
-)
+// a connection that stayed up this long resets the reconnect backoff
+const stableAfter = time.Second * 30
+
+var errInterrupted = errors.New("interrupted")
 
 func main() {
+	// read the config file, environment and flags, and refuse to start
+	// with a config that isn't right
+	loader := newLoader()
+	args, err := loader.Parse("client", os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected argument %q\n", args[0])
+		os.Exit(2)
+	}
+	cfg, err = loadConfig(loader)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	serveMetrics(cfg.MetricsListen)
+
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
+	loadKey()
+
+	// keep a session with the relay open, reconnecting when it drops
+	u := url.URL{Scheme: cfg.Relay.Scheme, Host: cfg.Relay.Host, Path: cfg.Relay.Path}
+	connect(u, &backoff{min: time.Second, max: time.Minute}, interrupt)
+}
 
-	// authorize to an illm relay as a provider
-	u := url.URL{Scheme: illm_scheme, Host: illm_host, Path: illm_path}
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{
-		"Authorization": []string{"Basic " + auth},
-	})
+// connect keeps a session with the relay at u open until the user
+// interrupts, waiting longer after each connection that drops quickly
+func connect(u url.URL, retry *backoff, interrupt chan os.Signal) {
+	for {
+		started := time.Now()
+		err := session(u, interrupt)
+		if errors.Is(err, errInterrupted) {
+			return
+		}
+		if time.Since(started) > stableAfter {
+			retry.reset()
+		}
+
+		reconnects.Inc()
+		delay := retry.next()
+		log.Printf("disconnected: %s, reconnecting in %s", err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-interrupt:
+			log.Println("interrupt")
+			return
+		}
+	}
+}
+
+// run one connection to the relay until it drops or the user interrupts.
+// Requests still running when it drops are cancelled rather than resumed,
+// since the relay fails them for their clients as soon as we disconnect.
+func session(u url.URL, interrupt chan os.Signal) error {
+	// authorize to an illm relay as a provider, with an API key if AUTH
+	// is one, basic auth otherwise, or only a client certificate if unset
+	header := http.Header{}
+	if strings.HasPrefix(cfg.Auth, "illm_") {
+		header.Set("Authorization", "Bearer "+cfg.Auth)
+	} else if cfg.Auth != "" {
+		header.Set("Authorization", "Basic "+cfg.Auth)
+	}
+	dialer, err := newDialer()
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	c, _, err := dialer.Dial(u.String(), header)
 	if err != nil {
-		log.Fatal("dial:", err)
+		return fmt.Errorf("dial: %w", err)
 	}
-	defer c.Close()
 	log.Printf("connected to %s", u.String())
 
-	// websocket client read loop
+	// every write goes through one writer, then the websocket client read
+	// loop, which must have finished cancelling this session's requests
+	// before the next session starts
+	w := newWriter(c)
+	watch(c)
 	done := make(chan struct{})
-	go read(c, done)
+	go read(c, w, done)
+	defer func() {
+		c.Close()
+		<-done
+		w.Close()
+	}()
+
+	// advertise installed models so the relay can route to us
+	err = handshake(w)
+	if err != nil {
+		log.Println("handshake:", err)
+	}
 
 	// program maintainance loop
-	ticker := time.NewTicker(time.Second * 45)
+	ticker := time.NewTicker(heartbeatPeriod)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-done:
-			return
+			return errors.New("connection closed")
 		case <-ticker.C:
-			err := c.WriteMessage(websocket.TextMessage, []byte("{\"action\": \"ping\"}"))
+			err := heartbeat(w)
 			if err != nil {
-				log.Println("write:", err)
-				return
+				return fmt.Errorf("heartbeat: %w", err)
+			}
+			err = refreshHandshake(w)
+			if err != nil {
+				log.Println("handshake:", err)
 			}
 		case <-interrupt:
 			log.Println("interrupt")
-			err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			err := w.WriteClose()
 			if err != nil {
 				log.Println("write close:", err)
-				return
+				return errInterrupted
 			}
 			select {
 			case <-done:
 			case <-time.After(time.Second):
 			}
-			return
+			return errInterrupted
 		}
 	}
 }
 
-func read(c *websocket.Conn, done chan struct{}) {
+func read(c *websocket.Conn, w *writer, done chan struct{}) {
 	defer close(done)
+	defer cancelAll()
+
+	jobs := make(chan job, jobQueueSize)
+	defer close(jobs)
+	for i := 0; i < cfg.Concurrency; i++ {
+		go work(w, jobs)
+	}
+
 	for {
 		_, message, err := c.ReadMessage()
 		if err != nil {
 			log.Println("read:", err)
 			return
 		}
+		alive(c)
 		req, err := decodeRequest(message)
 		if err != nil {
 			log.Println("decode:", err)
-			return
+			continue
 		}
-		log.Printf("recv: %s (tag %s)", req.Action, req.Tag)
+		log.Printf("recv: %s (tag %s, user %s)", req.Action, req.Tag, req.User)
 
 		switch req.Action {
-		case "generate":
-			completion, err := generate(c, req)
-			if err != nil {
-				log.Println("generate:", err)
-				return
+		case "cancel":
+			cancelRequest(req)
+		case "generate", "chat", "embed", "summarize-youtube":
+			if req.Sealed != nil {
+				if err := openSealed(req); err != nil {
+					sendError(w, req, internal.ErrInvalidRequest, "Could not decrypt request: "+err.Error())
+					continue
+				}
 			}
-			_ = completion
+			jobs <- job{req: req, run: track(req)}
+		case "error":
+			// the relay refused something we sent, such as our handshake
+			log.Println("relay:", req.Data)
 		case "identify":
-			res, err := encodeRequest(req.Tag, "identify", identifier)
+			res, err := encodeRequest(req, "identify", cfg.Identifier)
 			if err != nil {
 				log.Println("encode:", err)
-				return
+				continue
 			}
-			err = c.WriteMessage(websocket.TextMessage, res)
-		case "summarize-youtube":
-			complete, err := summarize(c, req)
+			err = w.Write(res)
 			if err != nil {
-				log.Println("summarize:", err)
-				return
+				log.Println("write:", err)
 			}
-			_ = complete
+		default:
+			sendError(w, req, internal.ErrInvalidRequest, "Unknown action "+req.Action)
 		}
 	}
 }
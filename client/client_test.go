@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ivynya/illm/internal"
+)
+
+// a local ollama with one model installed, failing while down is set
+func newTestOllama(t *testing.T, down *atomic.Bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down != nil && down.Load() {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != "/api/tags" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"models":[{"name":"llama3:latest","details":{"family":"llama"}}]}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// A relay that drops the provider's first connections is reconnected to,
+// and sent the handshake again each time
+func TestReconnectsAndHandshakesAgain(t *testing.T) {
+	const drops = 2
+	handshakes := make(chan *internal.Request, 10)
+	var connections atomic.Int32
+	upgrader := websocket.Upgrader{}
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Basic YTpi" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		req := &internal.Request{}
+		json.Unmarshal(message, req)
+		handshakes <- req
+
+		// Drop without a close frame, like a relay restarting
+		if connections.Add(1) <= drops {
+			return
+		}
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer relay.Close()
+
+	cfg = defaultConfig()
+	cfg.Auth = "YTpi"
+	cfg.Identifier = "box"
+	cfg.OllamaURL = newTestOllama(t, nil).URL
+	relayURL, _ := url.Parse(relay.URL)
+	u := url.URL{Scheme: "ws", Host: relayURL.Host, Path: cfg.Relay.Path}
+
+	interrupt := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		connect(u, &backoff{min: time.Millisecond, max: time.Millisecond * 20}, interrupt)
+	}()
+
+	for i := 0; i <= drops; i++ {
+		select {
+		case req := <-handshakes:
+			if req.Action != "handshake" || req.Handshake == nil {
+				t.Fatalf("connection %d: first message was %s, want a handshake", i, req.Action)
+			}
+			if req.Handshake.Identifier != "box" || len(req.Handshake.Models) != 1 || req.Handshake.Models[0] != "llama3:latest" {
+				t.Fatalf("connection %d: handshake %+v", i, req.Handshake)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("no handshake on connection %d", i)
+		}
+	}
+
+	// The last connection stays up until interrupted
+	interrupt <- os.Interrupt
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatal("provider didn't stop when interrupted")
+	}
+	if n := connections.Load(); n != drops+1 {
+		t.Fatalf("%d connections, want %d", n, drops+1)
+	}
+}
+
+// A handshake that fails at the start of a connection is sent by the next
+// refresh, even if the models are the ones the last connection advertised
+func TestHandshakeAfterOllamaComesBack(t *testing.T) {
+	received := make(chan *internal.Request, 10)
+	upgrader := websocket.Upgrader{}
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			_, message, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			req := &internal.Request{}
+			json.Unmarshal(message, req)
+			received <- req
+		}
+	}))
+	defer relay.Close()
+
+	var down atomic.Bool
+	cfg = defaultConfig()
+	cfg.OllamaURL = newTestOllama(t, &down).URL
+	c, _, err := websocket.DefaultDialer.Dial("ws"+relay.URL[len("http"):], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	w := newWriter(c)
+	defer w.Close()
+
+	// as advertised on the last connection
+	advertised, advertisedEmbed = []string{"llama3:latest"}, []string{}
+	down.Store(true)
+	if err := handshake(w); err == nil {
+		t.Fatal("handshake succeeded with ollama down")
+	}
+	down.Store(false)
+	if err := refreshHandshake(w); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case req := <-received:
+		if req.Action != "handshake" || req.Handshake == nil || len(req.Handshake.Models) != 1 {
+			t.Fatalf("got %s %+v, want a handshake", req.Action, req.Handshake)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no handshake once ollama came back")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/ivynya/illm/internal/config"
+)
+
+// Config is everything the provider can be configured with
+type Config struct {
+	Auth          string      `yaml:"auth"`
+	Identifier    string      `yaml:"identifier"`
+	Relay         RelayConfig `yaml:"relay"`
+	OllamaURL     string      `yaml:"ollama_url"`
+	Weight        int         `yaml:"weight"`
+	Concurrency   int         `yaml:"concurrency"`
+	MaxTokens     int         `yaml:"max_tokens"`
+	MaxNumCtx     int         `yaml:"max_num_ctx"`
+	KeyFile       string      `yaml:"key_file"`
+	MetricsListen string      `yaml:"metrics_listen"`
+	TLS           TLSConfig   `yaml:"tls"`
+}
+
+// where the relay is
+type RelayConfig struct {
+	Scheme string `yaml:"scheme"`
+	Host   string `yaml:"host"`
+	Path   string `yaml:"path"`
+}
+
+type TLSConfig struct {
+	Cert string `yaml:"cert"` // client certificate, for relays using mutual TLS
+	Key  string `yaml:"key"`
+	CA   string `yaml:"ca"` // CA to trust for the relay's certificate instead of the system's
+}
+
+// the provider's config, loaded at startup
+var cfg *Config
+
+func defaultConfig() *Config {
+	return &Config{
+		Relay:         RelayConfig{Scheme: "ws", Path: "/aura/provider"},
+		OllamaURL:     "http://127.0.0.1:11434",
+		Concurrency:   1,
+		KeyFile:       defaultKeyFile,
+		MetricsListen: defaultMetricsListen,
+	}
+}
+
+// every setting's environment variable and flag
+var settings = []config.Setting[Config]{
+	setting("AUTH", "", "", func(c *Config) any { return &c.Auth }),
+	setting("IDENTIFIER", "identifier", "`name` to identify as", func(c *Config) any { return &c.Identifier }),
+	setting("ILLM_SCHEME", "scheme", "relay `scheme`, ws or wss", func(c *Config) any { return &c.Relay.Scheme }),
+	setting("ILLM_HOST", "host", "relay `host` and optional port", func(c *Config) any { return &c.Relay.Host }),
+	setting("ILLM_PATH", "path", "relay provider endpoint `path`", func(c *Config) any { return &c.Relay.Path }),
+	setting("OLLAMA_URL", "ollama-url", "`URL` of the local ollama", func(c *Config) any { return &c.OllamaURL }),
+	setting("WEIGHT", "weight", "`weight` for the relay's weighted balancer, 0 lets it decide", func(c *Config) any { return &c.Weight }),
+	setting("CONCURRENCY", "concurrency", "`requests` to run at once", func(c *Config) any { return &c.Concurrency }),
+	setting("MAX_TOKENS", "max-tokens", "cap on `tokens` generated per request, 0 for none", func(c *Config) any { return &c.MaxTokens }),
+	setting("MAX_NUM_CTX", "max-num-ctx", "cap on the context window in `tokens`, 0 for none", func(c *Config) any { return &c.MaxNumCtx }),
+	setting("KEY_FILE", "key-file", "end-to-end encryption key `file`", func(c *Config) any { return &c.KeyFile }),
+	setting("METRICS_LISTEN", "metrics-listen", "local `address` to serve metrics on, empty to not serve them", func(c *Config) any { return &c.MetricsListen }),
+	setting("TLS_CERT", "tls-cert", "client certificate PEM `file`", func(c *Config) any { return &c.TLS.Cert }),
+	setting("TLS_KEY", "tls-key", "client certificate key PEM `file`", func(c *Config) any { return &c.TLS.Key }),
+	setting("TLS_CA", "tls-ca", "CA PEM `file` to trust for the relay", func(c *Config) any { return &c.TLS.CA }),
+}
+
+func setting(env string, flag string, usage string, field func(c *Config) any) config.Setting[Config] {
+	return config.Setting[Config]{Env: env, Flag: flag, Usage: usage, Field: field}
+}
+
+// validate reports everything wrong with the config at once
+func (c *Config) validate() error {
+	p := config.Problems{}
+	p.Check(c.Relay.Scheme == "ws" || c.Relay.Scheme == "wss", "relay.scheme must be ws or wss, got %q", c.Relay.Scheme)
+	p.Check(c.Relay.Host != "", "relay.host must be set")
+	u, err := url.Parse(c.OllamaURL)
+	p.Check(err == nil && u.Scheme != "" && u.Host != "", "ollama_url: %q is not an absolute URL", c.OllamaURL)
+	p.Check(c.Weight >= 0, "weight must not be negative")
+	p.Check(c.Concurrency >= 1, "concurrency must be at least 1")
+	p.Check(c.MaxTokens >= 0, "max_tokens must not be negative")
+	p.Check(c.MaxNumCtx >= 0, "max_num_ctx must not be negative")
+	p.Check(c.KeyFile != "", "key_file must be set")
+	if c.MetricsListen != "" {
+		_, _, err := net.SplitHostPort(c.MetricsListen)
+		p.Check(err == nil, "metrics_listen: %q is not host:port", c.MetricsListen)
+	}
+	p.Check((c.TLS.Cert == "") == (c.TLS.Key == ""), "tls.cert and tls.key must be set together")
+	for name, path := range map[string]string{"tls.cert": c.TLS.Cert, "tls.key": c.TLS.Key, "tls.ca": c.TLS.CA} {
+		if path != "" {
+			_, err := os.Stat(path)
+			p.Check(err == nil, "%s: %v", name, err)
+		}
+	}
+	return p.Err()
+}
+
+func newLoader() *config.Loader[Config] {
+	return &config.Loader[Config]{Defaults: defaultConfig, Settings: settings}
+}
+
+// load and validate the config
+func loadConfig(loader *config.Loader[Config]) (*Config, error) {
+	c, err := loader.Load()
+	if err != nil {
+		return nil, err
+	}
+	return c, c.validate()
+}
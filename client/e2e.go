@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"log"
+	"sync"
+
+	"github.com/ivynya/illm/internal"
+	"github.com/ivynya/illm/internal/e2e"
+)
+
+// where the provider's end-to-end encryption key is kept by default
+const defaultKeyFile = "illm_provider.key"
+
+// the provider's key, clients seal requests to its public half
+var providerKey *ecdh.PrivateKey
+
+// sessions of the sealed requests being handled, by request, so their
+// responses are sealed too
+var (
+	sealedMu sync.Mutex
+	sealed   = make(map[*internal.Request]*e2e.Session)
+)
+
+// load the provider's key, or create one on first run
+func loadKey() {
+	key, err := e2e.LoadOrCreateKey(cfg.KeyFile)
+	if err != nil {
+		log.Println("e2e key:", err, "- end-to-end encryption disabled")
+		return
+	}
+	providerKey = key
+	log.Println("e2e key fingerprint:", e2e.Fingerprint(key.PublicKey()))
+}
+
+// the public key to advertise at handshake, if there is one
+func publicKey() string {
+	if providerKey == nil {
+		return ""
+	}
+	return e2e.EncodePublicKey(providerKey.PublicKey())
+}
+
+// decrypt a sealed request in place and remember its session
+func openSealed(req *internal.Request) error {
+	if providerKey == nil {
+		return e2e.ErrWrongKey
+	}
+	s, err := e2e.OpenRequest(req, providerKey)
+	if err != nil {
+		return err
+	}
+	sealedMu.Lock()
+	sealed[req] = s
+	sealedMu.Unlock()
+	return nil
+}
+
+// the session of a sealed request, or nil
+func sessionOf(req *internal.Request) *e2e.Session {
+	sealedMu.Lock()
+	defer sealedMu.Unlock()
+	return sealed[req]
+}
+
+// forget a request's session once it has been handled
+func closeSealed(req *internal.Request) {
+	sealedMu.Lock()
+	delete(sealed, req)
+	sealedMu.Unlock()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/ivynya/illm/internal"
+	"github.com/ivynya/illm/ollama"
+)
+
+// number of vectors sent back per response, which keeps each websocket
+// message small however large the batch is
+const embedChunkSize = 8
+
+func embed(ctx context.Context, w *writer, req *internal.Request) error {
+	input := req.Generate.Input
+	if len(input) == 0 {
+		return &requestError{code: internal.ErrInvalidRequest, err: errors.New("embed needs at least one input text")}
+	}
+
+	llm, err := ollama.New(ollama.WithModel(req.Generate.Model), ollama.WithServerURL(cfg.OllamaURL))
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(input); start += embedChunkSize {
+		end := min(start+embedChunkSize, len(input))
+		embeddings, err := llm.CreateEmbedding(ctx, input[start:end])
+		if err != nil {
+			return err
+		}
+
+		chunk, err := json.Marshal(&internal.EmbedResponse{
+			Model:      req.Generate.Model,
+			Index:      start,
+			Embeddings: embeddings,
+			Done:       end == len(input),
+		})
+		if err != nil {
+			return err
+		}
+		resp, err := encodeRequest(req, "response", string(chunk))
+		if err != nil {
+			return err
+		}
+		err = w.Write(resp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/ivynya/illm/internal"
+	"github.com/ivynya/illm/ollama"
+)
+
+// requestError is a failure that already knows which error code it is
+type requestError struct {
+	code string
+	err  error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// classify maps a failed request to the error code sent back to the client
+func classify(ctx context.Context, err error) string {
+	var reqErr *requestError
+	var statusErr ollama.StatusError
+	var opErr *net.OpError
+	switch {
+	case ctx.Err() != nil:
+		return internal.ErrCancelled
+	case errors.As(err, &reqErr):
+		return reqErr.code
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound:
+		return internal.ErrModelNotFound
+	case errors.As(err, &opErr):
+		return internal.ErrOllamaUnreachable
+	}
+	return internal.ErrGenerationFailed
+}
+
+// tell the relay and client why a request failed, which also ends it
+func sendError(w *writer, req *internal.Request, code string, message string) {
+	requestErrors.WithLabelValues(code).Inc()
+	res, err := json.Marshal(internal.NewError(req, code, message))
+	if err == nil {
+		err = w.Write(res)
+	}
+	if err != nil {
+		log.Println("write:", err)
+	}
+}
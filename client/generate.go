@@ -2,35 +2,45 @@ package main
 
 import (
 	"context"
-	"log"
 
-	"github.com/gorilla/websocket"
 	"github.com/ivynya/illm/internal"
 	"github.com/ivynya/illm/ollama"
 	"github.com/tmc/langchaingo/llms"
 )
 
-func generate(c *websocket.Conn, req *internal.Request) ([]*llms.Generation, error) {
-	llm, err := ollama.New(ollama.WithModel(req.Generate.Model), ollama.WithServerURL(ollama_url))
+func generate(ctx context.Context, w *writer, req *internal.Request) ([]*llms.Generation, error) {
+	llmOpts, callOpts := generateOptions(req)
+	if len(req.Generate.Images) > 0 {
+		err := checkMultimodal(ctx, req.Generate.Model)
+		if err != nil {
+			return nil, err
+		}
+		images, err := decodeImages(req.Generate.Images)
+		if err != nil {
+			return nil, err
+		}
+		llmOpts = append(llmOpts, ollama.WithImages(images))
+	}
+	llm, err := ollama.New(append(llmOpts, ollama.WithModel(req.Generate.Model), ollama.WithServerURL(cfg.OllamaURL))...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	ctx := context.Background()
 	completion, err := llm.Generate(ctx,
 		[]string{req.Generate.Prompt},
 		req.Generate.Context,
-		llms.WithTemperature(0.8),
-		llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
-			resp, err := encodeRequest(req.Tag, "response", string(chunk))
-			if err != nil {
-				log.Fatal(err)
-			}
-			c.WriteMessage(websocket.TextMessage, resp)
-			return nil
-		}),
+		append(callOpts,
+			llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+				observeChunk(chunk)
+				resp, err := encodeRequest(req, "response", string(chunk))
+				if err != nil {
+					return err
+				}
+				return w.Write(resp)
+			}),
+		)...,
 	)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	return completion, nil
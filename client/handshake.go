@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/ivynya/illm/internal"
+	"github.com/ivynya/illm/ollama"
+)
+
+// models most recently advertised to the relay on this connection, nil
+// until a handshake has been sent on it
+var advertised, advertisedEmbed []string
+
+// client for the local ollama instance's API
+func ollamaClient() (*ollama.Client, error) {
+	u, err := url.Parse(cfg.OllamaURL)
+	if err != nil {
+		return nil, err
+	}
+	return ollama.NewClient(u)
+}
+
+// list the models installed in the local ollama instance, and which of
+// them are embedding models
+func listModels(ctx context.Context) ([]string, []string, error) {
+	client, err := ollamaClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	list, err := client.ListModels(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	models := make([]string, 0, len(list.Models))
+	embedModels := []string{}
+	for _, model := range list.Models {
+		models = append(models, model.Name)
+		if isEmbeddingModel(model.Details) {
+			embedModels = append(embedModels, model.Name)
+		}
+	}
+	return models, embedModels, nil
+}
+
+// embedding models are BERT-style encoders like nomic-embed-text and
+// mxbai-embed-large, which ollama reports as the bert or nomic-bert family
+func isEmbeddingModel(details ollama.ModelDetails) bool {
+	if strings.Contains(details.Family, "bert") {
+		return true
+	}
+	return slices.ContainsFunc(details.Families, func(family string) bool {
+		return strings.Contains(family, "bert")
+	})
+}
+
+// send the relay our identifier and installed models, at the start of a
+// connection. If it fails the next refresh sends it instead, whatever was
+// advertised on the last connection.
+func handshake(w *writer) error {
+	advertised, advertisedEmbed = nil, nil
+	models, embedModels, err := listModels(context.Background())
+	if err != nil {
+		return err
+	}
+	return advertise(w, models, embedModels)
+}
+
+// re-send the handshake if models were pulled or removed since the last one
+func refreshHandshake(w *writer) error {
+	models, embedModels, err := listModels(context.Background())
+	if err != nil {
+		return err
+	}
+	if advertised != nil && slices.Equal(models, advertised) && slices.Equal(embedModels, advertisedEmbed) {
+		return nil
+	}
+	return advertise(w, models, embedModels)
+}
+
+func advertise(w *writer, models []string, embedModels []string) error {
+	res, err := json.Marshal(&internal.Request{
+		Action: "handshake",
+		Handshake: &internal.Handshake{
+			Identifier:  cfg.Identifier,
+			Models:      models,
+			EmbedModels: embedModels,
+			Weight:      cfg.Weight,
+			Concurrency: cfg.Concurrency,
+			PublicKey:   publicKey(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	err = w.Write(res)
+	if err != nil {
+		return err
+	}
+	advertised, advertisedEmbed = models, embedModels
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ivynya/illm/internal"
+)
+
+const (
+	// time allowed to write a message before the relay is considered gone
+	writeWait = time.Second * 10
+
+	// a relay that sends nothing, not even a pong, for this long is dead
+	pongWait = time.Second * 60
+
+	// how often the relay is pinged and sent a heartbeat
+	heartbeatPeriod = time.Second * 45
+)
+
+// requests a worker is running right now
+var busy atomic.Int64
+
+// watch the connection for a half-open relay. Reads fail once it has been
+// silent for pongWait, which ends the session and reconnects.
+func watch(c *websocket.Conn) {
+	alive(c)
+	c.SetPongHandler(func(string) error {
+		return alive(c)
+	})
+	c.SetPingHandler(func(data string) error {
+		alive(c)
+		// WriteControl may be called alongside the writer goroutine
+		err := c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+}
+
+// push back the read deadline after hearing from the relay
+func alive(c *websocket.Conn) error {
+	return c.SetReadDeadline(time.Now().Add(pongWait))
+}
+
+// ping the relay and tell it how loaded we are
+func heartbeat(w *writer) error {
+	err := w.Ping()
+	if err != nil {
+		return err
+	}
+
+	running := int(busy.Load())
+	data, err := json.Marshal(&internal.Request{
+		Action: "heartbeat",
+		Heartbeat: &internal.Heartbeat{
+			Running:     running,
+			Waiting:     max(trackedCount()-running, 0),
+			Concurrency: cfg.Concurrency,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return w.Write(data)
+}
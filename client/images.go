@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ivynya/illm/internal"
+	"github.com/ivynya/illm/ollama"
+)
+
+// decode the base64 images attached to a request, with or without a
+// data URL prefix
+func decodeImages(images []string) ([]ollama.ImageData, error) {
+	decoded := make([]ollama.ImageData, 0, len(images))
+	for i, image := range images {
+		if _, data, ok := strings.Cut(image, ";base64,"); ok {
+			image = data
+		}
+		b, err := base64.StdEncoding.DecodeString(image)
+		if err != nil {
+			return nil, &requestError{code: internal.ErrInvalidRequest, err: fmt.Errorf("image %d: %w", i, err)}
+		}
+		decoded = append(decoded, b)
+	}
+	return decoded, nil
+}
+
+// check a model can take images, which ollama marks with the clip family
+func checkMultimodal(ctx context.Context, model string) error {
+	client, err := ollamaClient()
+	if err != nil {
+		return err
+	}
+	show, err := client.Show(ctx, &ollama.ShowRequest{Name: model})
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(show.Details.Families, "clip") {
+		return &requestError{code: internal.ErrModelNotMultimodal, err: fmt.Errorf("model %s does not accept images", model)}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// where metrics are served by default, only to this machine
+const defaultMetricsListen = "127.0.0.1:9464"
+
+// Models are only used as labels once ollama has run them, so remote users
+// can't create new series by asking for models that don't exist.
+var (
+	activeRequests = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "illm_provider_active_requests",
+		Help: "Requests being run right now.",
+	}, func() float64 {
+		return float64(busy.Load())
+	})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "illm_provider_request_duration_seconds",
+		Help:    "Time ollama took to complete a request, by action and model.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"action", "model"})
+
+	loadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "illm_provider_load_duration_seconds",
+		Help:    "Time ollama spent loading the model for a generation, from load_duration.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"model"})
+
+	promptEvalDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "illm_provider_prompt_eval_duration_seconds",
+		Help:    "Time ollama spent reading the prompt of a generation, from prompt_eval_duration.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"model"})
+
+	evalDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "illm_provider_eval_duration_seconds",
+		Help:    "Time ollama spent generating the response of a generation, from eval_duration.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"model"})
+
+	reconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "illm_provider_reconnects_total",
+		Help: "Times the connection to the relay dropped and was retried.",
+	})
+
+	requestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "illm_provider_errors_total",
+		Help: "Requests that failed, by error code.",
+	}, []string{"code"})
+)
+
+// the timings ollama reports in the final chunk of a generation or chat
+type chunkTimings struct {
+	Model              string        `json:"model"`
+	Done               bool          `json:"done"`
+	LoadDuration       time.Duration `json:"load_duration"`
+	PromptEvalDuration time.Duration `json:"prompt_eval_duration"`
+	EvalDuration       time.Duration `json:"eval_duration"`
+}
+
+// record the timings of a streamed chunk if it is the last one
+func observeChunk(chunk []byte) {
+	if !strings.Contains(string(chunk), `"done":true`) {
+		return
+	}
+	t := chunkTimings{}
+	if err := json.Unmarshal(chunk, &t); err != nil || !t.Done || t.Model == "" {
+		return
+	}
+	loadDuration.WithLabelValues(t.Model).Observe(t.LoadDuration.Seconds())
+	promptEvalDuration.WithLabelValues(t.Model).Observe(t.PromptEvalDuration.Seconds())
+	evalDuration.WithLabelValues(t.Model).Observe(t.EvalDuration.Seconds())
+}
+
+// serve metrics on addr until the provider exits. They tell whoever hosts
+// the provider what remote users are costing them, and aren't meant for
+// anyone else.
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && !isLoopback(host) {
+		log.Printf("metrics: %s is reachable from other machines", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Println("metrics:", http.ListenAndServe(addr, mux))
+	}()
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/ivynya/illm/internal"
+	"github.com/ivynya/illm/ollama"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// temperature used when a request doesn't set one
+const defaultTemperature = 0.8
+
+// most stop words a request may set
+const maxStopWords = 16
+
+// clamp the requested options to sane ranges and the provider's limits
+func clampOptions(opts internal.GenerateOptions) internal.GenerateOptions {
+	if opts.Temperature != nil {
+		temperature := clamp(*opts.Temperature, 0, 2)
+		opts.Temperature = &temperature
+	}
+	opts.TopP = clamp(opts.TopP, 0, 1)
+	opts.TypicalP = clamp(opts.TypicalP, 0, 1)
+	opts.TopK = max(opts.TopK, 0)
+	opts.RepeatPenalty = max(opts.RepeatPenalty, 0)
+	opts.Mirostat = clamp(opts.Mirostat, 0, 2)
+	opts.RepeatLastN = max(opts.RepeatLastN, -1)
+	opts.NumKeep = max(opts.NumKeep, 0)
+	opts.NumCtx = max(opts.NumCtx, 0)
+	if len(opts.Stop) > maxStopWords {
+		opts.Stop = opts.Stop[:maxStopWords]
+	}
+
+	if limit := cfg.MaxTokens; limit > 0 && (opts.MaxTokens <= 0 || opts.MaxTokens > limit) {
+		opts.MaxTokens = limit
+	}
+	if limit := cfg.MaxNumCtx; limit > 0 && opts.NumCtx > limit {
+		opts.NumCtx = limit
+	}
+	return opts
+}
+
+// map request options onto the ollama LLM's options and call options
+func generateOptions(req *internal.Request) ([]ollama.Option, []llms.CallOption) {
+	opts := internal.GenerateOptions{}
+	if req.Generate.Options != nil {
+		opts = *req.Generate.Options
+	}
+	opts = clampOptions(opts)
+	temperature := defaultTemperature
+	if opts.Temperature != nil {
+		temperature = *opts.Temperature
+	}
+
+	llmOpts := []ollama.Option{
+		ollama.WithRunnerNumCtx(opts.NumCtx),
+		ollama.WithRunnerNumKeep(opts.NumKeep),
+		ollama.WithPredictMirostat(opts.Mirostat),
+		ollama.WithPredictMirostatTau(float32(opts.MirostatTau)),
+		ollama.WithPredictMirostatEta(float32(opts.MirostatEta)),
+		ollama.WithPredictRepeatLastN(opts.RepeatLastN),
+		ollama.WithPredictTypicalP(float32(opts.TypicalP)),
+		ollama.WithPredictTFSZ(float32(opts.TFSZ)),
+		ollama.WithPredictPenalizeNewline(opts.PenalizeNewline),
+		// set on the LLM rather than per call, as only these can be 0
+		ollama.WithPredictTemperature(float32(temperature)),
+	}
+	if opts.Seed != nil {
+		llmOpts = append(llmOpts, ollama.WithPredictSeed(*opts.Seed))
+	}
+	if req.Generate.System != "" {
+		llmOpts = append(llmOpts, ollama.WithSystemPrompt(req.Generate.System))
+	}
+	callOpts := []llms.CallOption{
+		llms.WithTopK(opts.TopK),
+		llms.WithTopP(opts.TopP),
+		llms.WithStopWords(opts.Stop),
+		llms.WithMaxTokens(opts.MaxTokens),
+		llms.WithRepetitionPenalty(opts.RepeatPenalty),
+		llms.WithFrequencyPenalty(opts.FrequencyPenalty),
+		llms.WithPresencePenalty(opts.PresencePenalty),
+	}
+	return llmOpts, callOpts
+}
+
+func clamp[T int | float64](v T, lo T, hi T) T {
+	return min(max(v, lo), hi)
+}
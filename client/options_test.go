@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ivynya/illm/internal"
+	"github.com/ivynya/illm/ollama"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestClampOptions(t *testing.T) {
+	cfg = defaultConfig()
+	cfg.MaxTokens = 100
+	cfg.MaxNumCtx = 4096
+
+	tests := []struct {
+		name string
+		in   internal.GenerateOptions
+		want internal.GenerateOptions
+	}{
+		{"unset stays unset", internal.GenerateOptions{}, internal.GenerateOptions{MaxTokens: 100}},
+		{"zero temperature and seed are kept",
+			internal.GenerateOptions{Temperature: ptr(0.0), Seed: ptr(0)},
+			internal.GenerateOptions{Temperature: ptr(0.0), Seed: ptr(0), MaxTokens: 100}},
+		{"temperature clamped",
+			internal.GenerateOptions{Temperature: ptr(5.0)},
+			internal.GenerateOptions{Temperature: ptr(2.0), MaxTokens: 100}},
+		{"negative values clamped",
+			internal.GenerateOptions{Temperature: ptr(-1.0), TopK: -1, TopP: -1, RepeatPenalty: -1, NumCtx: -8, NumKeep: -1, RepeatLastN: -5},
+			internal.GenerateOptions{Temperature: ptr(0.0), RepeatLastN: -1, MaxTokens: 100}},
+		{"provider limits",
+			internal.GenerateOptions{MaxTokens: 1000, NumCtx: 32768},
+			internal.GenerateOptions{MaxTokens: 100, NumCtx: 4096}},
+		{"within limits",
+			internal.GenerateOptions{MaxTokens: 50, NumCtx: 2048, TopP: 0.9, RepeatPenalty: 1.1},
+			internal.GenerateOptions{MaxTokens: 50, NumCtx: 2048, TopP: 0.9, RepeatPenalty: 1.1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clampOptions(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The options a request sets are the ones ollama is asked for, including
+// a temperature and seed of 0
+func TestOptionsReachOllama(t *testing.T) {
+	cfg = defaultConfig()
+	sent := make(chan map[string]any, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Options map[string]any `json:"options"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		sent <- body.Options
+		w.Write([]byte(`{"model":"llama3","response":"hi","done":true}`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		options     *internal.GenerateOptions
+		temperature float64
+		seed        any // nil when ollama should pick one
+	}{
+		{"defaults", nil, defaultTemperature, nil},
+		{"zero", &internal.GenerateOptions{Temperature: ptr(0.0), Seed: ptr(0)}, 0, 0.0},
+		{"set", &internal.GenerateOptions{Temperature: ptr(1.5), Seed: ptr(42)}, 1.5, 42.0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &internal.Request{Action: "generate"}
+			req.Generate.Model = "llama3"
+			req.Generate.Options = tt.options
+			llmOpts, callOpts := generateOptions(req)
+			llm, err := ollama.New(append(llmOpts, ollama.WithModel("llama3"), ollama.WithServerURL(srv.URL))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := llm.Generate(context.Background(), []string{"hello"}, nil, callOpts...); err != nil {
+				t.Fatal(err)
+			}
+
+			options := <-sent
+			if temperature, ok := options["temperature"].(float64); !ok || float32(temperature) != float32(tt.temperature) {
+				t.Errorf("temperature %v, want %v", options["temperature"], tt.temperature)
+			}
+			if seed := options["seed"]; seed != tt.seed {
+				t.Errorf("seed %v, want %v", seed, tt.seed)
+			}
+		})
+	}
+}
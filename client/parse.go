@@ -15,12 +15,18 @@ func decodeRequest(message []byte) (*internal.Request, error) {
 	return req, nil
 }
 
-func encodeRequest(tag string, action string, data string) ([]byte, error) {
+// encode a response to req, keeping its tag and request ID so the relay
+// and client can match it up. Responses to sealed requests are sealed.
+func encodeRequest(req *internal.Request, action string, data string) ([]byte, error) {
 	resp := &internal.Request{
-		Tag:    tag,
+		Tag:    req.Tag,
+		ID:     req.ID,
 		Action: action,
 		Data:   data,
 	}
+	if s := sessionOf(req); s != nil && action == "response" {
+		s.SealResponse(resp)
+	}
 	respJson, err := json.Marshal(resp)
 	if err != nil {
 		return nil, err
@@ -1,27 +1,27 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"strconv"
 
-	"github.com/gorilla/websocket"
 	"github.com/ivynya/illm/internal"
 	"github.com/ivynya/illm/ollama"
 	"github.com/kkdai/youtube/v2"
 )
 
-func summarize(c *websocket.Conn, req *internal.Request) (bool, error) {
+func summarize(ctx context.Context, w *writer, req *internal.Request) (bool, error) {
 	videoID := req.Data
 	client := youtube.Client{}
 
-	video, err := client.GetVideo(videoID)
+	video, err := client.GetVideoContext(ctx, videoID)
 	if err != nil {
-		return false, err
+		return false, &requestError{code: internal.ErrVideoUnavailable, err: err}
 	}
 
-	transcript, err := client.GetTranscript(video)
+	transcript, err := client.GetTranscriptCtx(ctx, video)
 	if err != nil {
-		return false, err
+		return false, &requestError{code: internal.ErrTranscriptUnavailable, err: err}
 	}
 
 	info := &ollama.GenerateResponse{
@@ -33,16 +33,19 @@ func summarize(c *websocket.Conn, req *internal.Request) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	infoResp, err := encodeRequest(req.Tag, "response", string(infoJson))
+	infoResp, err := encodeRequest(req, "response", string(infoJson))
+	if err != nil {
+		return false, err
+	}
+	err = w.Write(infoResp)
 	if err != nil {
 		return false, err
 	}
-	c.WriteMessage(websocket.TextMessage, infoResp)
 
 	req.Generate.Prompt = "Summarize the following video. Only include information from the video in your response. Video: " + video.Title + "\n\n" + transcript.String() + "\n\nSummary:"
 	req.Generate.Context = []int{}
 
-	complete, err := generate(c, req)
+	complete, err := generate(ctx, w, req)
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+
+	"github.com/gorilla/websocket"
+)
+
+// a websocket dialer presenting the configured client certificate and
+// trusting the configured CA
+func newDialer() (*websocket.Dialer, error) {
+	dialer := *websocket.DefaultDialer
+	t := cfg.TLS
+	if t.Cert == "" && t.Key == "" && t.CA == "" {
+		return &dialer, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("tls.ca: no certificates found")
+		}
+		config.RootCAs = pool
+	}
+	dialer.TLSClientConfig = config
+	return &dialer, nil
+}
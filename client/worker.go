@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ivynya/illm/internal"
+)
+
+// number of accepted requests that may wait for a free worker
+const jobQueueSize = 64
+
+// an accepted request and the context it runs under
+type job struct {
+	req *internal.Request
+	run *running
+}
+
+// handle accepted requests off the read loop, so other requests and
+// cancels are still received while a generation is running. Each of the
+// cfg.Concurrency workers runs one request at a time.
+func work(w *writer, jobs <-chan job) {
+	for j := range jobs {
+		busy.Add(1)
+		handle(j.run.ctx, w, j.req)
+		busy.Add(-1)
+		untrack(j.req, j.run)
+		closeSealed(j.req)
+	}
+}
+
+func handle(ctx context.Context, w *writer, req *internal.Request) {
+	started := time.Now()
+	var err error
+	switch req.Action {
+	case "generate":
+		_, err = generate(ctx, w, req)
+	case "chat":
+		_, err = chat(ctx, w, req)
+	case "embed":
+		err = embed(ctx, w, req)
+	case "summarize-youtube":
+		_, err = summarize(ctx, w, req)
+	}
+	if err == nil {
+		requestDuration.WithLabelValues(req.Action, req.Generate.Model).Observe(time.Since(started).Seconds())
+		return
+	}
+
+	code := classify(ctx, err)
+	if code == internal.ErrCancelled {
+		sendError(w, req, code, "Request cancelled")
+		return
+	}
+	log.Printf("%s: %s (%s)", req.Action, err, code)
+	sendError(w, req, code, err.Error())
+}
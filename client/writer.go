@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var errWriterClosed = errors.New("writer closed")
+
+// writer owns every write to a websocket connection, since gorilla only
+// allows one goroutine to write at a time. Workers, the handshake and the
+// heartbeat ticker all queue their messages here.
+type writer struct {
+	c    *websocket.Conn
+	out  chan outbound
+	done chan struct{}
+}
+
+// a message waiting to be written and where to report the result
+type outbound struct {
+	messageType int
+	data        []byte
+	result      chan error
+}
+
+func newWriter(c *websocket.Conn) *writer {
+	w := &writer{
+		c:    c,
+		out:  make(chan outbound),
+		done: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *writer) run() {
+	for {
+		select {
+		case msg := <-w.out:
+			w.c.SetWriteDeadline(time.Now().Add(writeWait))
+			msg.result <- w.c.WriteMessage(msg.messageType, msg.data)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Write sends a text message and waits until it has been written, so a
+// fast generation can't outrun a slow connection
+func (w *writer) Write(data []byte) error {
+	return w.send(websocket.TextMessage, data)
+}
+
+// Ping sends a websocket ping, which the relay answers with a pong
+func (w *writer) Ping() error {
+	return w.send(websocket.PingMessage, nil)
+}
+
+// WriteClose sends a normal closure message
+func (w *writer) WriteClose() error {
+	return w.send(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+func (w *writer) send(messageType int, data []byte) error {
+	msg := outbound{messageType: messageType, data: data, result: make(chan error, 1)}
+	select {
+	case w.out <- msg:
+	case <-w.done:
+		return errWriterClosed
+	}
+	return <-msg.result
+}
+
+// Close stops the writer, later writes fail with errWriterClosed
+func (w *writer) Close() {
+	close(w.done)
+}
@@ -0,0 +1,165 @@
+// Package config loads settings for the relay and the provider from a YAML
+// file, environment variables and command line flags.
+//
+// Each setting starts at its default, then takes its value from the file,
+// then from its environment variable and last from its flag, so a flag
+// always wins. The file is named by the -config flag or the CONFIG
+// environment variable and is optional.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Setting ties one field of a config struct T to its environment variable
+// and flag. Field returns a pointer to the field, which must be a *string,
+// *int, *bool or *[]string. Lists are comma separated in the environment
+// and on the command line.
+type Setting[T any] struct {
+	Env   string
+	Flag  string
+	Usage string
+	Field func(c *T) any
+}
+
+// Loader reads a T from its sources. It can load again later, to pick up
+// changes to the file.
+type Loader[T any] struct {
+	Defaults func() *T
+	Settings []Setting[T]
+
+	path  string
+	flags map[string]string // values given on the command line, by flag
+}
+
+// Parse reads the flags on the command line and returns the arguments
+// after them. Flag values are kept and applied over the file and
+// environment on every Load.
+func (l *Loader[T]) Parse(name string, args []string) ([]string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&l.path, "config", os.Getenv("CONFIG"), "YAML config `file`, or CONFIG")
+	l.flags = make(map[string]string)
+	for _, s := range l.Settings {
+		if s.Flag == "" {
+			continue
+		}
+		flagName := s.Flag
+		usage := s.Usage
+		if s.Env != "" {
+			usage += ", or " + s.Env
+		}
+		fs.Func(flagName, usage, func(value string) error {
+			l.flags[flagName] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return fs.Args(), nil
+}
+
+// Path of the config file, or "" if there is none
+func (l *Loader[T]) Path() string {
+	return l.path
+}
+
+// Load builds a T from the defaults, the file, the environment and the
+// flags. Every value that can't be used is reported, not just the first.
+func (l *Loader[T]) Load() (*T, error) {
+	c := l.Defaults()
+	if l.path != "" {
+		data, err := os.ReadFile(l.path)
+		if err != nil {
+			return nil, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %w", l.path, err)
+		}
+	}
+
+	var errs []error
+	// empty variables count as unset, as compose files often leave them
+	for _, s := range l.Settings {
+		if value := os.Getenv(s.Env); s.Env != "" && value != "" {
+			if err := set(s.Field(c), value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.Env, err))
+			}
+		}
+	}
+	for _, s := range l.Settings {
+		if value, ok := l.flags[s.Flag]; ok {
+			if err := set(s.Field(c), value); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", s.Flag, err))
+			}
+		}
+	}
+	return c, errors.Join(errs...)
+}
+
+func set(field any, value string) error {
+	switch p := field.(type) {
+	case *string:
+		*p = value
+	case *int:
+		if value == "" {
+			*p = 0
+			return nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		*p = n
+	case *bool:
+		if value == "" {
+			*p = false
+			return nil
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		*p = b
+	case *[]string:
+		*p = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*p = append(*p, item)
+			}
+		}
+	default:
+		panic(fmt.Sprintf("config: unsupported field type %T", field))
+	}
+	return nil
+}
+
+// Problems collects what is wrong with a config so it can all be reported
+// at once
+type Problems []string
+
+// Check records a problem unless ok
+func (p *Problems) Check(ok bool, format string, args ...any) {
+	if !ok {
+		*p = append(*p, fmt.Sprintf(format, args...))
+	}
+}
+
+// Err is nil if there were no problems
+func (p Problems) Err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return errors.New("invalid config:\n  " + strings.Join(p, "\n  "))
+}
@@ -0,0 +1,180 @@
+// Package e2e encrypts requests between clients and providers so the relay
+// only sees what it needs to route them.
+//
+// A provider has a long-lived X25519 key and advertises the public half in
+// its handshake. A client seals each request to one provider's key with a
+// fresh ephemeral key, and the provider seals its responses with the key
+// they share. Request payloads and responses are encrypted with AES-GCM
+// under nonces that count up in each direction, so the relay can't read
+// either, nor reorder, replay or reflect responses. It can resend a whole
+// sealed request, which the provider will run again, but the responses are
+// sealed to the original client and tell the relay nothing new.
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"sync"
+)
+
+var ErrDecrypt = errors.New("e2e: message could not be decrypted")
+
+// direction of a message, the first byte of its nonce
+const (
+	toProvider byte = 1
+	toClient   byte = 2
+)
+
+// GenerateKey creates a provider key
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// LoadOrCreateKey reads a provider key from path, creating it if it does
+// not exist yet, so the key and its fingerprint survive restarts
+func LoadOrCreateKey(path string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return ecdh.X25519().NewPrivateKey(data)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, key.Bytes(), 0600)
+}
+
+// EncodePublicKey encodes a public key for a handshake
+func EncodePublicKey(key *ecdh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key.Bytes())
+}
+
+// ParsePublicKey decodes a public key encoded by EncodePublicKey
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(data)
+}
+
+// Fingerprint is a short, stable name for a public key. Requests name the
+// key they are sealed to by it, and users can compare it with the one a
+// provider logs to be sure the relay didn't substitute its own key.
+func Fingerprint(key *ecdh.PublicKey) string {
+	sum := sha256.Sum256(key.Bytes())
+	return hex.EncodeToString(sum[:16])
+}
+
+// Session is the shared key of one request
+type Session struct {
+	Ephemeral   string // the client's public key for this request
+	Fingerprint string // of the provider key the request is sealed to
+
+	aead cipher.AEAD
+	send byte
+
+	mu      sync.Mutex
+	sent    uint64
+	receive uint64
+}
+
+// Dial starts a session with a provider, from the client's side
+func Dial(provider *ecdh.PublicKey) (*Session, error) {
+	ephemeral, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(provider)
+	if err != nil {
+		return nil, err
+	}
+	return newSession(shared, ephemeral.PublicKey(), provider, toProvider)
+}
+
+// Accept joins the session a client started, from the provider's side
+func Accept(key *ecdh.PrivateKey, ephemeral string) (*Session, error) {
+	client, err := ParsePublicKey(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := key.ECDH(client)
+	if err != nil {
+		return nil, err
+	}
+	return newSession(shared, client, key.PublicKey(), toClient)
+}
+
+func newSession(shared []byte, client *ecdh.PublicKey, provider *ecdh.PublicKey, send byte) (*Session, error) {
+	// bind the key to both public keys so neither can be swapped
+	h := sha256.New()
+	h.Write([]byte("illm e2e v1"))
+	h.Write(shared)
+	h.Write(client.Bytes())
+	h.Write(provider.Bytes())
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		Ephemeral:   EncodePublicKey(client),
+		Fingerprint: Fingerprint(provider),
+		aead:        aead,
+		send:        send,
+	}, nil
+}
+
+func (s *Session) nonce(direction byte, n uint64) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	nonce[0] = direction
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+// Seal encrypts the next message this side sends
+func (s *Session) Seal(plaintext []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sealed := s.aead.Seal(nil, s.nonce(s.send, s.sent), plaintext, nil)
+	s.sent++
+	return base64.StdEncoding.EncodeToString(sealed)
+}
+
+// Open decrypts the next message the other side sent. Messages must be
+// opened in the order they were sealed.
+func (s *Session) Open(sealed string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	direction := toClient
+	if s.send == toClient {
+		direction = toProvider
+	}
+	plaintext, err := s.aead.Open(nil, s.nonce(direction, s.receive), data, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	s.receive++
+	return plaintext, nil
+}
@@ -0,0 +1,244 @@
+package e2e
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ivynya/illm/internal"
+)
+
+const secretPrompt = "the launch code is 0000"
+
+func newKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newRequest() *internal.Request {
+	req := &internal.Request{Tag: "tag", ID: "1", Action: "generate", Data: "client data"}
+	req.Generate.Model = "llama3"
+	req.Generate.Prompt = secretPrompt
+	req.Generate.System = "be brief"
+	req.Generate.Images = []string{"aW1hZ2U="}
+	return req
+}
+
+// relay passes a request or response through JSON, as it would on the wire
+func relay(t *testing.T, req *internal.Request) *internal.Request {
+	t.Helper()
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &internal.Request{}
+	if err := json.Unmarshal(data, out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// a provider's response, the last one if done
+func response(data string, done bool) *internal.Request {
+	res := &internal.Request{Tag: "tag", ID: "1", Action: "response", Data: `{"response":"` + data + `","done":false}`}
+	if done {
+		res.Data = `{"response":"","done":true,"prompt_eval_count":3,"eval_count":7,"eval_duration":1000}`
+	}
+	return res
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	key := newKey(t)
+	req := newRequest()
+	want := newRequest()
+
+	client, err := SealRequest(req, key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	onWire := relay(t, req)
+	provider, err := OpenRequest(onWire, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onWire.Data != want.Data || onWire.Generate.Prompt != want.Generate.Prompt ||
+		onWire.Generate.System != want.Generate.System || onWire.Generate.Model != want.Generate.Model ||
+		len(onWire.Generate.Images) != 1 || onWire.Generate.Images[0] != want.Generate.Images[0] {
+		t.Fatalf("opened %+v, want %+v", onWire.Generate, want.Generate)
+	}
+
+	// Responses come back in order, with the stats the relay needs readable
+	frames := []*internal.Request{response("hel", false), response("lo", false), response("", true)}
+	for i, frame := range frames {
+		plaintext := frame.Data
+		provider.SealResponse(frame)
+		sealed := relay(t, frame)
+		if strings.Contains(sealed.Data, "response") {
+			t.Fatalf("frame %d sent in the clear: %s", i, sealed.Data)
+		}
+		done := i == len(frames)-1
+		if sealed.Sealed == nil || sealed.Sealed.Done != done {
+			t.Fatalf("frame %d: sealed %+v, want done %v", i, sealed.Sealed, done)
+		}
+		if done && (sealed.Sealed.PromptEvalCount != 3 || sealed.Sealed.EvalCount != 7) {
+			t.Fatalf("last frame's counts hidden from the relay: %+v", sealed.Sealed)
+		}
+		if err := client.OpenResponse(sealed); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if sealed.Data != plaintext || sealed.Sealed != nil {
+			t.Fatalf("frame %d opened to %q, want %q", i, sealed.Data, plaintext)
+		}
+	}
+}
+
+// The relay sees the model and the key it is sealed to, and nothing else
+func TestSealedRequestHidesPayload(t *testing.T) {
+	key := newKey(t)
+	req := newRequest()
+	if _, err := SealRequest(req, key.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{secretPrompt, "be brief", "aW1hZ2U=", "client data"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("sealed request contains %q: %s", secret, data)
+		}
+	}
+	if !strings.Contains(string(data), `"model":"llama3"`) {
+		t.Errorf("sealed request hides the model needed to route it: %s", data)
+	}
+	if req.Sealed.Key != Fingerprint(key.PublicKey()) {
+		t.Errorf("sealed to %s, want %s", req.Sealed.Key, Fingerprint(key.PublicKey()))
+	}
+}
+
+func TestWrongKeyIsRejected(t *testing.T) {
+	key, other := newKey(t), newKey(t)
+
+	req := newRequest()
+	SealRequest(req, key.PublicKey())
+	if _, err := OpenRequest(relay(t, req), other); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("opened with another key: got %v, want ErrWrongKey", err)
+	}
+
+	// Claiming the other key's fingerprint doesn't help either
+	forged := relay(t, req)
+	forged.Sealed.Key = Fingerprint(other.PublicKey())
+	if _, err := OpenRequest(forged, other); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("opened with a forged fingerprint: got %v, want ErrDecrypt", err)
+	}
+
+	if _, err := OpenRequest(newRequest(), key); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("opened a request that isn't sealed: got %v, want ErrWrongKey", err)
+	}
+}
+
+func TestTamperedRequestIsRejected(t *testing.T) {
+	key := newKey(t)
+	req := newRequest()
+	SealRequest(req, key.PublicKey())
+
+	tampered := relay(t, req)
+	data := []byte(tampered.Data)
+	data[len(data)/2] ^= 'A' ^ 'B'
+	tampered.Data = string(data)
+	if _, err := OpenRequest(tampered, key); err == nil {
+		t.Fatal("opened a request the relay changed")
+	}
+}
+
+func TestReplayedAndReorderedResponsesAreRejected(t *testing.T) {
+	key := newKey(t)
+	req := newRequest()
+	client, _ := SealRequest(req, key.PublicKey())
+	provider, err := OpenRequest(relay(t, req), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := make([]*internal.Request, 3)
+	for i := range sealed {
+		frame := response(string(rune('a'+i)), false)
+		provider.SealResponse(frame)
+		sealed[i] = frame
+	}
+	open := func(i int) error {
+		return client.OpenResponse(relay(t, sealed[i]))
+	}
+
+	if err := open(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := open(0); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("replayed response: got %v, want ErrDecrypt", err)
+	}
+	if err := open(2); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("response out of order: got %v, want ErrDecrypt", err)
+	}
+	// Rejected frames don't advance the session, so the right one still opens
+	if err := open(1); err != nil {
+		t.Fatalf("next response after rejections: %v", err)
+	}
+	if err := open(2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A request's ciphertext can't be reflected back to the client as a
+// response, nor a response opened by another request's session
+func TestCrossSessionAndReflectionAreRejected(t *testing.T) {
+	key := newKey(t)
+	first, second := newRequest(), newRequest()
+	client, _ := SealRequest(first, key.PublicKey())
+	otherClient, _ := SealRequest(second, key.PublicKey())
+	provider, err := OpenRequest(relay(t, first), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reflected := &internal.Request{Data: first.Data, Sealed: &internal.Sealed{Key: first.Sealed.Key}}
+	if err := client.OpenResponse(reflected); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("request reflected as a response: got %v, want ErrDecrypt", err)
+	}
+
+	res := response("hi", false)
+	provider.SealResponse(res)
+	if err := otherClient.OpenResponse(relay(t, res)); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("response opened by another session: got %v, want ErrDecrypt", err)
+	}
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "provider.key")
+	created, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created.Equal(loaded) {
+		t.Fatal("loaded a different key than was created")
+	}
+
+	encoded := EncodePublicKey(created.PublicKey())
+	parsed, err := ParsePublicKey(encoded)
+	if err != nil || Fingerprint(parsed) != Fingerprint(created.PublicKey()) {
+		t.Fatalf("public key didn't survive encoding: %v", err)
+	}
+	if _, err := ParsePublicKey("bm90IGEga2V5"); err == nil {
+		t.Fatal("parsed a public key of the wrong length")
+	}
+}
@@ -0,0 +1,98 @@
+package e2e
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+
+	"github.com/ivynya/illm/internal"
+)
+
+var ErrWrongKey = errors.New("e2e: request is sealed to a different key")
+
+// what a sealed request hides from the relay
+type payload struct {
+	Data     string          `json:"data"`
+	Generate json.RawMessage `json:"generate"`
+}
+
+// SealRequest encrypts a request's data and generate parameters to a
+// provider's key, leaving only the model readable for routing. The
+// returned session opens the responses.
+func SealRequest(req *internal.Request, provider *ecdh.PublicKey) (*Session, error) {
+	s, err := Dial(provider)
+	if err != nil {
+		return nil, err
+	}
+	generate, err := json.Marshal(req.Generate)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(payload{Data: req.Data, Generate: generate})
+	if err != nil {
+		return nil, err
+	}
+
+	model := req.Generate.Model
+	req.Generate = (&internal.Request{}).Generate
+	req.Generate.Model = model
+	req.Data = s.Seal(plaintext)
+	req.Sealed = &internal.Sealed{Key: s.Fingerprint, Ephemeral: s.Ephemeral}
+	return s, nil
+}
+
+// OpenRequest decrypts a sealed request in place with the provider's key.
+// The returned session seals the responses.
+func OpenRequest(req *internal.Request, key *ecdh.PrivateKey) (*Session, error) {
+	if req.Sealed == nil || req.Sealed.Key != Fingerprint(key.PublicKey()) {
+		return nil, ErrWrongKey
+	}
+	s, err := Accept(key, req.Sealed.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := s.Open(req.Data)
+	if err != nil {
+		return nil, err
+	}
+	p := payload{}
+	if err := json.Unmarshal(plaintext, &p); err != nil {
+		return nil, err
+	}
+
+	// the model the relay routed on is the one that runs
+	model := req.Generate.Model
+	if err := json.Unmarshal(p.Generate, &req.Generate); err != nil {
+		return nil, err
+	}
+	req.Generate.Model = model
+	req.Data = p.Data
+	return s, nil
+}
+
+// SealResponse encrypts a response's data on the provider. Whether it is
+// the last response and the token counts in it stay readable, since the
+// relay balances providers and enforces quotas with them.
+func (s *Session) SealResponse(res *internal.Request) {
+	sealed := &internal.Sealed{Key: s.Fingerprint}
+	json.Unmarshal([]byte(res.Data), sealed)
+	sealed.Key, sealed.Ephemeral = s.Fingerprint, ""
+
+	res.Data = s.Seal([]byte(res.Data))
+	res.Sealed = sealed
+}
+
+// OpenResponse decrypts a sealed response's data in place on the client.
+// Responses that aren't sealed, such as errors, are left alone.
+func (s *Session) OpenResponse(res *internal.Request) error {
+	if res.Sealed == nil {
+		return nil
+	}
+	plaintext, err := s.Open(res.Data)
+	if err != nil {
+		return err
+	}
+	res.Data = string(plaintext)
+	res.Sealed = nil
+	return nil
+}
@@ -0,0 +1,43 @@
+package internal
+
+// Error codes carried by error actions
+const (
+	ErrModelUnavailable    = "model_unavailable"
+	ErrProviderUnavailable = "provider_unavailable"
+	ErrQueueFull           = "queue_full"
+	ErrCancelled           = "cancelled"
+	ErrImageTooLarge       = "image_too_large"
+	ErrProviderNotAllowed  = "provider_not_allowed"
+	ErrRateLimited         = "rate_limited"
+
+	// sent by providers
+	ErrInvalidRequest        = "invalid_request"
+	ErrModelNotFound         = "model_not_found"
+	ErrModelNotMultimodal    = "model_not_multimodal"
+	ErrOllamaUnreachable     = "ollama_unreachable"
+	ErrVideoUnavailable      = "video_unavailable"
+	ErrTranscriptUnavailable = "transcript_unavailable"
+	ErrGenerationFailed      = "generation_failed"
+)
+
+// Error is the machine-readable part of an error action
+type Error struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after,omitempty"` // seconds to wait before retrying
+}
+
+// NewError builds an error action in response to req. Data repeats the
+// message for clients that only display data.
+func NewError(req *Request, code string, message string) *Request {
+	return &Request{
+		Tag:    req.Tag,
+		ID:     req.ID,
+		Action: "error",
+		Data:   message,
+		Error: &Error{
+			Code:    code,
+			Message: message,
+		},
+	}
+}
@@ -2,12 +2,122 @@ package internal
 
 // Request struct
 type Request struct {
-	Tag      string `json:"tag,omitempty"` // unique client identifier
-	Action   string `json:"action"`        // action to perform
-	Data     string `json:"data"`          // data to send back
+	Tag      string `json:"tag,omitempty"`  // unique client identifier
+	ID       string `json:"id,omitempty"`   // client-chosen request identifier
+	User     string `json:"user,omitempty"` // who the client authenticated as
+	Action   string `json:"action"`         // action to perform
+	Data     string `json:"data"`           // data to send back
 	Generate struct {
-		Model   string `json:"model"`
-		Prompt  string `json:"prompt"`
-		Context []int  `json:"context,omitempty"`
+		Model    string           `json:"model"`
+		Prompt   string           `json:"prompt"`
+		System   string           `json:"system,omitempty"` // overrides the model's system prompt
+		Context  []int            `json:"context,omitempty"`
+		Messages []Message        `json:"messages,omitempty"` // chat history for the chat action
+		Images   []string         `json:"images,omitempty"`   // base64 images for vision models
+		Input    []string         `json:"input,omitempty"`    // texts for the embed action
+		Options  *GenerateOptions `json:"options,omitempty"`
 	} `json:"generate"`
+	Handshake *Handshake   `json:"handshake,omitempty"` // sent by providers on connect
+	Heartbeat *Heartbeat   `json:"heartbeat,omitempty"` // sent by providers periodically
+	Error     *Error       `json:"error,omitempty"`     // set on error actions
+	Queue     *QueueStatus `json:"queue,omitempty"`     // set on queued actions
+	Sealed    *Sealed      `json:"sealed,omitempty"`    // set when data is end-to-end encrypted
+}
+
+// Key identifies a request among everything in flight on the relay
+func (r *Request) Key() string {
+	return r.Tag + "/" + r.ID
+}
+
+// Message is one turn of a chat
+type Message struct {
+	Role    string   `json:"role"` // one of system, user, assistant
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"` // base64 images for vision models
+}
+
+// Images returns every image attached to the request
+func (r *Request) Images() []string {
+	images := r.Generate.Images
+	for _, message := range r.Generate.Messages {
+		images = append(images, message.Images...)
+	}
+	return images
+}
+
+// GenerateOptions tune a generation. Zero values leave the provider's or
+// model's default in place, and providers may clamp anything else.
+// Temperature and seed are pointers since 0 is a value worth asking for;
+// nil leaves their defaults.
+type GenerateOptions struct {
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopK             int      `json:"top_k,omitempty"`
+	TopP             float64  `json:"top_p,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	MaxTokens        int      `json:"max_tokens,omitempty"` // ollama's num_predict
+	RepeatPenalty    float64  `json:"repeat_penalty,omitempty"`
+	RepeatLastN      int      `json:"repeat_last_n,omitempty"`
+	PresencePenalty  float64  `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float64  `json:"frequency_penalty,omitempty"`
+	Mirostat         int      `json:"mirostat,omitempty"`
+	MirostatTau      float64  `json:"mirostat_tau,omitempty"`
+	MirostatEta      float64  `json:"mirostat_eta,omitempty"`
+	TypicalP         float64  `json:"typical_p,omitempty"`
+	TFSZ             float64  `json:"tfs_z,omitempty"`
+	NumCtx           int      `json:"num_ctx,omitempty"`
+	NumKeep          int      `json:"num_keep,omitempty"`
+	PenalizeNewline  bool     `json:"penalize_newline,omitempty"`
+}
+
+// EmbedResponse is the data of a response to an embed action. Large
+// batches are answered over several responses of a few vectors each.
+type EmbedResponse struct {
+	Model      string      `json:"model"`
+	Index      int         `json:"index"` // position in the input of the first vector
+	Embeddings [][]float32 `json:"embeddings"`
+	Done       bool        `json:"done"`
+}
+
+// Handshake describes a provider to the relay
+type Handshake struct {
+	Identifier  string   `json:"identifier"`
+	Models      []string `json:"models"`                 // installed ollama models
+	EmbedModels []string `json:"embed_models,omitempty"` // the subset that are embedding models
+	Weight      int      `json:"weight,omitempty"`       // share of traffic for weighted balancing
+	Concurrency int      `json:"concurrency,omitempty"`  // requests it will run at once, default 1
+	PublicKey   string   `json:"public_key,omitempty"`   // for end-to-end encrypted requests
+}
+
+// ProviderKey is a provider's public key, as listed by the keys action
+type ProviderKey struct {
+	Identifier  string `json:"identifier"`
+	PublicKey   string `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Sealed marks an end-to-end encrypted request or response. Data holds
+// the ciphertext, and on requests everything in generate but the model is
+// inside it. The rest stays readable for routing, balancing and quotas.
+type Sealed struct {
+	Key             string `json:"key"`                 // fingerprint of the provider key
+	Ephemeral       string `json:"ephemeral,omitempty"` // the client's key for this request
+	Done            bool   `json:"done,omitempty"`      // set on the last response
+	PromptEvalCount int    `json:"prompt_eval_count,omitempty"`
+	EvalCount       int    `json:"eval_count,omitempty"`
+	EvalDuration    int64  `json:"eval_duration,omitempty"`  // nanoseconds
+	TotalDuration   int64  `json:"total_duration,omitempty"` // nanoseconds
+}
+
+// Heartbeat reports a provider's load to the relay
+type Heartbeat struct {
+	Running     int `json:"running"`     // requests generating now
+	Waiting     int `json:"waiting"`     // accepted requests waiting for a free worker
+	Concurrency int `json:"concurrency"` // requests it will run at once
+}
+
+// QueueStatus tells a client where its request is waiting
+type QueueStatus struct {
+	Position int `json:"position"`      // 1 is next to run
+	ETA      int `json:"eta,omitempty"` // estimated seconds until it starts
 }
@@ -54,28 +54,7 @@ func (o *LLM) Generate(ctx context.Context, prompts []string, chatContext []int,
 		o.CallbacksHandler.HandleLLMStart(ctx, prompts)
 	}
 
-	opts := llms.CallOptions{}
-	for _, opt := range options {
-		opt(&opts)
-	}
-
-	// Load back CallOptions as ollamaOptions
-	ollamaOptions := o.options.ollamaOptions
-	ollamaOptions.NumPredict = opts.MaxTokens
-	ollamaOptions.Temperature = float32(opts.Temperature)
-	ollamaOptions.Stop = opts.StopWords
-	ollamaOptions.TopK = opts.TopK
-	ollamaOptions.TopP = float32(opts.TopP)
-	ollamaOptions.Seed = opts.Seed
-	ollamaOptions.RepeatPenalty = float32(opts.RepetitionPenalty)
-	ollamaOptions.FrequencyPenalty = float32(opts.FrequencyPenalty)
-	ollamaOptions.PresencePenalty = float32(opts.PresencePenalty)
-
-	// Override LLM model if set as llms.CallOption
-	model := o.options.model
-	if opts.Model != "" {
-		model = opts.Model
-	}
+	opts, ollamaOptions, model := o.callOptions(options)
 
 	generations := make([]*llms.Generation, 0, len(prompts))
 
@@ -87,6 +66,7 @@ func (o *LLM) Generate(ctx context.Context, prompts []string, chatContext []int,
 			Template: o.options.customModelTemplate,
 			Options:  ollamaOptions,
 			Context:  chatContext,
+			Images:   o.options.images,
 			Stream:   func(b bool) *bool { return &b }(opts.StreamingFunc != nil),
 		}
 
@@ -122,6 +102,92 @@ func (o *LLM) Generate(ctx context.Context, prompts []string, chatContext []int,
 	return generations, nil
 }
 
+// Chat sends a conversation to ollama's chat endpoint and returns the
+// assistant's reply. Streamed chunks are passed to the streaming func as
+// JSON encoded ChatResponses.
+func (o *LLM) Chat(ctx context.Context, messages []*Message, options ...llms.CallOption) (*llms.Generation, error) {
+	if o.CallbacksHandler != nil {
+		prompts := make([]string, 0, len(messages))
+		for _, message := range messages {
+			prompts = append(prompts, message.Content)
+		}
+		o.CallbacksHandler.HandleLLMStart(ctx, prompts)
+	}
+
+	opts, ollamaOptions, model := o.callOptions(options)
+
+	req := &ChatRequest{
+		Model:    model,
+		Messages: messages,
+		Options:  ollamaOptions,
+		Stream:   func(b bool) *bool { return &b }(opts.StreamingFunc != nil),
+	}
+	if o.options.system != "" {
+		req.Messages = append([]*Message{{Role: "system", Content: o.options.system}}, messages...)
+	}
+
+	var output string
+	fn := func(response ChatResponse) error {
+		if opts.StreamingFunc != nil {
+			j, err := json.Marshal(response)
+			if err != nil {
+				return err
+			}
+			if err := opts.StreamingFunc(ctx, j); err != nil {
+				return err
+			}
+		}
+		if response.Message != nil {
+			output += response.Message.Content
+		}
+		return nil
+	}
+
+	err := o.client.GenerateChat(ctx, req, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	generation := &llms.Generation{Text: output}
+	if o.CallbacksHandler != nil {
+		o.CallbacksHandler.HandleLLMEnd(ctx, llms.LLMResult{Generations: [][]*llms.Generation{{generation}}})
+	}
+
+	return generation, nil
+}
+
+// Load CallOptions and the LLM's options into ollama options, and pick the
+// model, which can be overridden with a llms.CallOption
+func (o *LLM) callOptions(options []llms.CallOption) (llms.CallOptions, Options, string) {
+	opts := llms.CallOptions{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	ollamaOptions := o.options.ollamaOptions
+	ollamaOptions.NumPredict = opts.MaxTokens
+	if opts.Temperature != 0 {
+		temperature := float32(opts.Temperature)
+		ollamaOptions.Temperature = &temperature
+	}
+	ollamaOptions.Stop = opts.StopWords
+	ollamaOptions.TopK = opts.TopK
+	ollamaOptions.TopP = float32(opts.TopP)
+	if opts.Seed != 0 {
+		ollamaOptions.Seed = &opts.Seed
+	}
+	ollamaOptions.RepeatPenalty = float32(opts.RepetitionPenalty)
+	ollamaOptions.FrequencyPenalty = float32(opts.FrequencyPenalty)
+	ollamaOptions.PresencePenalty = float32(opts.PresencePenalty)
+
+	model := o.options.model
+	if opts.Model != "" {
+		model = opts.Model
+	}
+
+	return opts, ollamaOptions, model
+}
+
 func (o *LLM) CreateEmbedding(ctx context.Context, inputTexts []string) ([][]float32, error) {
 	embeddings := [][]float32{}
 
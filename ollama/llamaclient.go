@@ -160,10 +160,6 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 			return err
 		}
 
-		if errorResponse.Error != "" {
-			return fmt.Errorf(errorResponse.Error) //nolint
-		}
-
 		if response.StatusCode >= http.StatusBadRequest {
 			return StatusError{
 				StatusCode:   response.StatusCode,
@@ -172,6 +168,10 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 			}
 		}
 
+		if errorResponse.Error != "" {
+			return fmt.Errorf(errorResponse.Error) //nolint
+		}
+
 		if err := fn(bts); err != nil {
 			return err
 		}
@@ -214,3 +214,19 @@ func (c *Client) CreateEmbedding(ctx context.Context, req *EmbeddingRequest) (*E
 	}
 	return resp, nil
 }
+
+func (c *Client) Show(ctx context.Context, req *ShowRequest) (*ShowResponse, error) {
+	resp := &ShowResponse{}
+	if err := c.do(ctx, http.MethodPost, "/api/show", req, &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+func (c *Client) ListModels(ctx context.Context) (*ListResponse, error) {
+	resp := &ListResponse{}
+	if err := c.do(ctx, http.MethodGet, "/api/tags", nil, &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
@@ -29,12 +29,13 @@ func (e StatusError) Error() string {
 }
 
 type GenerateRequest struct {
-	Model    string `json:"model"`
-	Prompt   string `json:"prompt"`
-	System   string `json:"system"`
-	Template string `json:"template"`
-	Context  []int  `json:"context,omitempty"`
-	Stream   *bool  `json:"stream"`
+	Model    string      `json:"model"`
+	Prompt   string      `json:"prompt"`
+	System   string      `json:"system"`
+	Template string      `json:"template"`
+	Context  []int       `json:"context,omitempty"`
+	Stream   *bool       `json:"stream"`
+	Images   []ImageData `json:"images,omitempty"`
 
 	Options Options `json:"options"`
 }
@@ -75,6 +76,40 @@ type EmbeddingResponse struct {
 	Embedding []float32 `json:"embedding"`
 }
 
+type ModelDetails struct {
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+type ModelResponse struct {
+	Name       string       `json:"name"`
+	Model      string       `json:"model"`
+	ModifiedAt time.Time    `json:"modified_at"`
+	Size       int64        `json:"size"`
+	Digest     string       `json:"digest"`
+	Details    ModelDetails `json:"details,omitempty"`
+}
+
+type ShowRequest struct {
+	Name string `json:"name"`
+}
+
+type ShowResponse struct {
+	License    string       `json:"license,omitempty"`
+	Modelfile  string       `json:"modelfile,omitempty"`
+	Parameters string       `json:"parameters,omitempty"`
+	Template   string       `json:"template,omitempty"`
+	System     string       `json:"system,omitempty"`
+	Details    ModelDetails `json:"details,omitempty"`
+}
+
+type ListResponse struct {
+	Models []ModelResponse `json:"models"`
+}
+
 type GenerateResponse struct {
 	CreatedAt          time.Time     `json:"created_at"`
 	Model              string        `json:"model"`
@@ -150,22 +185,22 @@ type Runner struct {
 type Options struct {
 	Stop []string `json:"stop,omitempty"`
 	Runner
-	RepeatLastN      int     `json:"repeat_last_n,omitempty"`
-	Seed             int     `json:"seed,omitempty"`
-	TopK             int     `json:"top_k,omitempty"`
-	NumKeep          int     `json:"num_keep,omitempty"`
-	Mirostat         int     `json:"mirostat,omitempty"`
-	NumPredict       int     `json:"num_predict,omitempty"`
-	Temperature      float32 `json:"temperature,omitempty"`
-	TypicalP         float32 `json:"typical_p,omitempty"`
-	RepeatPenalty    float32 `json:"repeat_penalty,omitempty"`
-	PresencePenalty  float32 `json:"presence_penalty,omitempty"`
-	FrequencyPenalty float32 `json:"frequency_penalty,omitempty"`
-	TFSZ             float32 `json:"tfs_z,omitempty"`
-	MirostatTau      float32 `json:"mirostat_tau,omitempty"`
-	MirostatEta      float32 `json:"mirostat_eta,omitempty"`
-	TopP             float32 `json:"top_p,omitempty"`
-	PenalizeNewline  bool    `json:"penalize_newline,omitempty"`
+	RepeatLastN      int      `json:"repeat_last_n,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	TopK             int      `json:"top_k,omitempty"`
+	NumKeep          int      `json:"num_keep,omitempty"`
+	Mirostat         int      `json:"mirostat,omitempty"`
+	NumPredict       int      `json:"num_predict,omitempty"`
+	Temperature      *float32 `json:"temperature,omitempty"`
+	TypicalP         float32  `json:"typical_p,omitempty"`
+	RepeatPenalty    float32  `json:"repeat_penalty,omitempty"`
+	PresencePenalty  float32  `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float32  `json:"frequency_penalty,omitempty"`
+	TFSZ             float32  `json:"tfs_z,omitempty"`
+	MirostatTau      float32  `json:"mirostat_tau,omitempty"`
+	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
+	TopP             float32  `json:"top_p,omitempty"`
+	PenalizeNewline  bool     `json:"penalize_newline,omitempty"`
 }
 
 type options struct {
@@ -174,6 +209,7 @@ type options struct {
 	ollamaOptions       Options
 	customModelTemplate string
 	system              string
+	images              []ImageData
 }
 
 type Option func(*options)
@@ -195,6 +231,13 @@ func WithSystemPrompt(p string) Option {
 	}
 }
 
+// WithImages Attach images to the prompt for multimodal models like llava.
+func WithImages(images []ImageData) Option {
+	return func(opts *options) {
+		opts.images = images
+	}
+}
+
 // WithCustomTemplate To override the templating done on Ollama model side.
 func WithCustomTemplate(template string) Option {
 	return func(opts *options) {
@@ -388,6 +431,22 @@ func WithPredictMirostatEta(val float32) Option {
 	}
 }
 
+// WithPredictTemperature The temperature of the model. Unlike llms.WithTemperature it can be set
+// to 0, for the most likely output (Default: 0.8).
+func WithPredictTemperature(val float32) Option {
+	return func(opts *options) {
+		opts.ollamaOptions.Temperature = &val
+	}
+}
+
+// WithPredictSeed Sets the random number seed to use for generation. Unlike llms.WithSeed it can be
+// set to 0 (Default: random).
+func WithPredictSeed(val int) Option {
+	return func(opts *options) {
+		opts.ollamaOptions.Seed = &val
+	}
+}
+
 // WithPredictPenalizeNewline Penalize newline tokens when applying the repeat penalty (default: true).
 func WithPredictPenalizeNewline(val bool) Option {
 	return func(opts *options) {
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// roles an identity can have. Admins may use every endpoint, the others
+// only their own.
+const (
+	roleAdmin    = "admin"
+	roleClient   = "client"
+	roleProvider = "provider"
+)
+
+func validRole(role string) bool {
+	return role == roleAdmin || role == roleClient || role == roleProvider
+}
+
+// the admin login, which a config reload can change
+var admin struct {
+	sync.RWMutex
+	username string
+	password string
+}
+
+func setAdmin(username string, password string) {
+	admin.Lock()
+	defer admin.Unlock()
+	admin.username, admin.password = username, password
+}
+
+// whether user and pass are the admin login
+func isAdmin(user string, pass string) bool {
+	admin.RLock()
+	defer admin.RUnlock()
+	return admin.username != "" &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(admin.username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(admin.password)) == 1
+}
+
+// identity is who a request was authenticated as
+type identity struct {
+	User string
+	Role string
+}
+
+// authenticate accepts an API key as a bearer token, or as the password of
+// basic auth for clients that can only send that. The configured admin
+// username and password still work and authenticate as an admin. Without
+// credentials, a verified client certificate authenticates a provider
+// named by its common name.
+func authenticate(users *Users) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		header := c.Get(fiber.HeaderAuthorization)
+		if cert := clientCert(c); header == "" && cert != nil {
+			c.Locals("identity", &identity{User: cert.Subject.CommonName, Role: roleProvider})
+			return c.Next()
+		}
+
+		id, ok := authorize(users, header)
+		if !ok {
+			c.Set(fiber.HeaderWWWAuthenticate, "Basic realm=\"Restricted\"")
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		c.Locals("identity", id)
+		return c.Next()
+	}
+}
+
+func authorize(users *Users, header string) (*identity, bool) {
+	scheme, credentials, _ := strings.Cut(header, " ")
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		if key, ok := users.Lookup(credentials); ok {
+			return &identity{User: key.User, Role: key.role()}, true
+		}
+	case "basic":
+		raw, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return nil, false
+		}
+		user, pass, _ := strings.Cut(string(raw), ":")
+		if isAdmin(user, pass) {
+			return &identity{User: user, Role: roleAdmin}, true
+		}
+		if key, ok := users.Lookup(pass); ok {
+			return &identity{User: key.User, Role: key.role()}, true
+		}
+	}
+	return nil, false
+}
+
+// the identity authenticate attached to a request, given its "identity"
+// local, which fiber and websocket handlers read differently
+func identityOf(local interface{}) *identity {
+	id, _ := local.(*identity)
+	if id == nil {
+		return &identity{}
+	}
+	return id
+}
+
+// requireRole lets through admins and identities with the given role
+func requireRole(role string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := identityOf(c.Locals("identity"))
+		if id.Role != role && id.Role != roleAdmin {
+			return c.SendStatus(fiber.StatusForbidden)
+		}
+		return c.Next()
+	}
+}
+
+// Endpoints for managing API keys, open to admins only
+func adminRoutes(app fiber.Router, users *Users) {
+	admin := app.Group("/admin", requireRole(roleAdmin))
+
+	admin.Get("/keys", func(c *fiber.Ctx) error {
+		keys, err := users.List()
+		if err != nil {
+			return err
+		}
+		return c.JSON(keys)
+	})
+
+	admin.Post("/keys", func(c *fiber.Ctx) error {
+		body := struct {
+			User string `json:"user"`
+			Role string `json:"role"`
+		}{Role: roleClient}
+		if err := c.BodyParser(&body); err != nil || body.User == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "user is required"})
+		}
+		if !validRole(body.Role) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "role must be admin, client or provider"})
+		}
+		token, key, err := users.Create(body.User, body.Role)
+		if err != nil {
+			return err
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"key": token, "id": key.ID, "user": key.User, "role": key.Role})
+	})
+
+	admin.Delete("/keys/:id", func(c *fiber.Ctx) error {
+		err := users.Revoke(c.Params("id"))
+		if errors.Is(err, errKeyNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+}
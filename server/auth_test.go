@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func basic(user string, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func TestAuthorize(t *testing.T) {
+	users := newTestUsers(t)
+	client, _, _ := users.Create("alice", roleClient)
+	provider, _, _ := users.Create("box", roleProvider)
+	setAdmin("admin", "secret")
+	t.Cleanup(func() { setAdmin("", "") })
+
+	tests := []struct {
+		name   string
+		header string
+		user   string // empty when refused
+		role   string
+	}{
+		{"bearer key", "Bearer " + client, "alice", roleClient},
+		{"bearer is case insensitive", "bearer " + provider, "box", roleProvider},
+		{"key as basic password", basic("anyone", client), "alice", roleClient},
+		{"admin login", basic("admin", "secret"), "admin", roleAdmin},
+		{"wrong admin password", basic("admin", "guess"), "", ""},
+		{"admin password as bearer", "Bearer secret", "", ""},
+		{"unknown key", "Bearer " + keyPrefix + "0000", "", ""},
+		{"key as basic user", basic(client, ""), "", ""},
+		{"malformed basic", "Basic !!!", "", ""},
+		{"no scheme", client, "", ""},
+		{"nothing", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok := authorize(users, tt.header)
+			if tt.user == "" {
+				if ok {
+					t.Fatalf("authorized as %+v", id)
+				}
+				return
+			}
+			if !ok || id.User != tt.user || id.Role != tt.role {
+				t.Fatalf("got %+v, want %s as %s", id, tt.user, tt.role)
+			}
+		})
+	}
+}
+
+// With no admin configured, an empty admin login isn't one
+func TestNoAdminLogin(t *testing.T) {
+	setAdmin("", "")
+	if id, ok := authorize(newTestUsers(t), basic("", "")); ok {
+		t.Fatalf("authorized as %+v", id)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	users := newTestUsers(t)
+	app := fiber.New()
+	app.Use(authenticate(users))
+	app.Get("/provider", requireRole(roleProvider), func(c *fiber.Ctx) error {
+		return c.SendString(identityOf(c.Locals("identity")).User)
+	})
+	setAdmin("admin", "secret")
+	t.Cleanup(func() { setAdmin("", "") })
+	client, _, _ := users.Create("alice", roleClient)
+	provider, _, _ := users.Create("box", roleProvider)
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"provider", "Bearer " + provider, fiber.StatusOK},
+		{"admin", basic("admin", "secret"), fiber.StatusOK},
+		{"client", "Bearer " + client, fiber.StatusForbidden},
+		{"no credentials", "", fiber.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/provider", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			res, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", res.StatusCode, tt.status)
+			}
+			if tt.status == fiber.StatusUnauthorized && res.Header.Get("WWW-Authenticate") == "" {
+				t.Fatal("401 without a WWW-Authenticate header")
+			}
+		})
+	}
+}
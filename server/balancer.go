@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// Balancer picks which of the providers able to serve a request gets it.
+// Pick is only called with at least one provider.
+type Balancer interface {
+	Pick(providers []*Provider) *Provider
+}
+
+// newBalancer returns the strategy with the given name, random by default
+func newBalancer(name string) (Balancer, error) {
+	switch name {
+	case "", "random":
+		return randomBalancer{}, nil
+	case "least-outstanding":
+		return leastOutstandingBalancer{}, nil
+	case "weighted":
+		return &weightedBalancer{}, nil
+	case "latency":
+		return latencyBalancer{}, nil
+	}
+	return nil, fmt.Errorf("unknown balancer %q", name)
+}
+
+// randomBalancer picks any provider
+type randomBalancer struct{}
+
+func (randomBalancer) Pick(providers []*Provider) *Provider {
+	return providers[rand.Intn(len(providers))]
+}
+
+// leastOutstandingBalancer picks the provider running the fewest requests
+type leastOutstandingBalancer struct{}
+
+func (leastOutstandingBalancer) Pick(providers []*Provider) *Provider {
+	return pickMax(providers, func(p *Provider) float64 {
+		return -float64(p.Outstanding())
+	})
+}
+
+// weightedBalancer is a smooth weighted round-robin over the weights
+// providers sent at handshake
+type weightedBalancer struct {
+	mu sync.Mutex // guards Provider.current
+}
+
+func (b *weightedBalancer) Pick(providers []*Provider) *Provider {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total := 0
+	var best *Provider
+	for _, p := range providers {
+		weight := p.Weight()
+		p.current += weight
+		total += weight
+		if best == nil || p.current > best.current {
+			best = p
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// latencyBalancer picks the provider with the best measured tokens/sec,
+// shared between the requests it is already running. Providers that have
+// not finished a request yet are tried first so they get measured.
+type latencyBalancer struct{}
+
+func (latencyBalancer) Pick(providers []*Provider) *Provider {
+	return pickMax(providers, func(p *Provider) float64 {
+		tps := p.TokensPerSecond()
+		if tps == 0 {
+			return math.Inf(1)
+		}
+		return tps / float64(p.Outstanding()+1)
+	})
+}
+
+// pick the provider with the highest score, breaking ties randomly
+func pickMax(providers []*Provider, score func(*Provider) float64) *Provider {
+	var best []*Provider
+	bestScore := math.Inf(-1)
+	for _, p := range providers {
+		s := score(p)
+		switch {
+		case s > bestScore:
+			best, bestScore = []*Provider{p}, s
+		case s == bestScore:
+			best = append(best, p)
+		}
+	}
+	return best[rand.Intn(len(best))]
+}
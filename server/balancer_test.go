@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// a provider for balancing, with what the balancers look at
+type testProvider struct {
+	tag          string
+	weight       int
+	outstanding  int
+	tokensPerSec float64
+}
+
+func newTestProviders(specs ...testProvider) []*Provider {
+	providers := make([]*Provider, len(specs))
+	for i, s := range specs {
+		p := &Provider{Conn: &Conn{Tag: s.tag}, weight: s.weight, tokensPerSec: s.tokensPerSec}
+		p.outstanding.Store(int64(s.outstanding))
+		providers[i] = p
+	}
+	return providers
+}
+
+// how many times each provider is picked in n picks
+func pickCounts(b Balancer, providers []*Provider, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[b.Pick(providers).Tag]++
+	}
+	return counts
+}
+
+func TestNewBalancer(t *testing.T) {
+	tests := []struct {
+		name string
+		want Balancer
+	}{
+		{"", randomBalancer{}},
+		{"random", randomBalancer{}},
+		{"least-outstanding", leastOutstandingBalancer{}},
+		{"weighted", &weightedBalancer{}},
+		{"latency", latencyBalancer{}},
+	}
+	for _, tt := range tests {
+		b, err := newBalancer(tt.name)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.name, err)
+		}
+		if got, want := fmt.Sprintf("%T", b), fmt.Sprintf("%T", tt.want); got != want {
+			t.Errorf("%q: got %s, want %s", tt.name, got, want)
+		}
+	}
+	if _, err := newBalancer("round-robin"); err == nil {
+		t.Error("unknown balancer accepted")
+	}
+}
+
+func TestBalancerPicks(t *testing.T) {
+	tests := []struct {
+		name      string
+		balancer  Balancer
+		providers []testProvider
+		want      []string // the providers that may be picked, each at least once
+	}{
+		{
+			name:      "random picks every provider",
+			balancer:  randomBalancer{},
+			providers: []testProvider{{tag: "a"}, {tag: "b"}, {tag: "c"}},
+			want:      []string{"a", "b", "c"},
+		},
+		{
+			name:      "random with one provider",
+			balancer:  randomBalancer{},
+			providers: []testProvider{{tag: "a"}},
+			want:      []string{"a"},
+		},
+		{
+			name:      "least-outstanding picks the least busy",
+			balancer:  leastOutstandingBalancer{},
+			providers: []testProvider{{tag: "a", outstanding: 3}, {tag: "b", outstanding: 1}, {tag: "c", outstanding: 2}},
+			want:      []string{"b"},
+		},
+		{
+			name:      "least-outstanding breaks ties randomly",
+			balancer:  leastOutstandingBalancer{},
+			providers: []testProvider{{tag: "a", outstanding: 1}, {tag: "b"}, {tag: "c"}},
+			want:      []string{"b", "c"},
+		},
+		{
+			name:      "latency prefers unmeasured providers",
+			balancer:  latencyBalancer{},
+			providers: []testProvider{{tag: "fast", tokensPerSec: 100}, {tag: "new"}, {tag: "slow", tokensPerSec: 10}},
+			want:      []string{"new"},
+		},
+		{
+			name:      "latency tries every unmeasured provider",
+			balancer:  latencyBalancer{},
+			providers: []testProvider{{tag: "fast", tokensPerSec: 100}, {tag: "new"}, {tag: "newer", outstanding: 2}},
+			want:      []string{"new", "newer"},
+		},
+		{
+			name:      "latency picks the fastest",
+			balancer:  latencyBalancer{},
+			providers: []testProvider{{tag: "fast", tokensPerSec: 100}, {tag: "slow", tokensPerSec: 10}},
+			want:      []string{"fast"},
+		},
+		{
+			name:      "latency shares speed between running requests",
+			balancer:  latencyBalancer{},
+			providers: []testProvider{{tag: "fast", tokensPerSec: 100, outstanding: 4}, {tag: "slow", tokensPerSec: 30}},
+			want:      []string{"slow"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts := pickCounts(tt.balancer, newTestProviders(tt.providers...), 300)
+			for _, tag := range tt.want {
+				if counts[tag] == 0 {
+					t.Errorf("%s never picked: %v", tag, counts)
+				}
+				delete(counts, tag)
+			}
+			if len(counts) > 0 {
+				t.Errorf("picked providers it shouldn't have: %v", counts)
+			}
+		})
+	}
+}
+
+func TestWeightedBalancerDistribution(t *testing.T) {
+	tests := []struct {
+		name      string
+		providers []testProvider
+		want      map[string]int // picks per round of the total weight
+	}{
+		{"equal", []testProvider{{tag: "a", weight: 1}, {tag: "b", weight: 1}}, map[string]int{"a": 1, "b": 1}},
+		{"unset weights count as 1", []testProvider{{tag: "a"}, {tag: "b", weight: 2}}, map[string]int{"a": 1, "b": 2}},
+		{"skewed", []testProvider{{tag: "a", weight: 5}, {tag: "b", weight: 1}, {tag: "c", weight: 1}}, map[string]int{"a": 5, "b": 1, "c": 1}},
+		{"uneven", []testProvider{{tag: "a", weight: 3}, {tag: "b", weight: 2}, {tag: "c", weight: 4}}, map[string]int{"a": 3, "b": 2, "c": 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &weightedBalancer{}
+			providers := newTestProviders(tt.providers...)
+			total := 0
+			for _, n := range tt.want {
+				total += n
+			}
+			// Every round of total picks matches the weights exactly
+			for round := 0; round < 5; round++ {
+				counts := pickCounts(b, providers, total)
+				for tag, n := range tt.want {
+					if counts[tag] != n {
+						t.Fatalf("round %d: %v, want %v", round, counts, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Smooth round-robin spreads a heavy provider's picks out rather than
+// picking it many times in a row
+func TestWeightedBalancerIsSmooth(t *testing.T) {
+	b := &weightedBalancer{}
+	providers := newTestProviders(testProvider{tag: "a", weight: 5}, testProvider{tag: "b", weight: 1}, testProvider{tag: "c", weight: 1})
+	got := ""
+	for i := 0; i < 7; i++ {
+		got += b.Pick(providers).Tag
+	}
+	if want := "aabacaa"; got != want {
+		t.Fatalf("picked %s, want %s", got, want)
+	}
+}
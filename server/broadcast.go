@@ -2,69 +2,61 @@ package main
 
 import (
 	"encoding/json"
-	"math/rand"
 	"strconv"
+	"strings"
 
-	"github.com/gofiber/websocket/v2"
 	"github.com/ivynya/illm/internal"
 )
 
-func tagRequest(tag string, req *internal.Request) *internal.Request {
-	req.Tag = tag
+// tag the request with the client it came from and who that client is
+func tagRequest(client *Conn, req *internal.Request) *internal.Request {
+	req.Tag = client.Tag
+	req.User = client.User
 	return req
 }
 
-// pick a random provider and send the request to it
-func broadcastToProvider(c map[string]*websocket.Conn, req *internal.Request) error {
-	data, err := json.Marshal(req)
-	if err != nil {
-		return err
-	}
-
-	if len(c) == 0 {
-		return nil
+// send the request to every provider
+func broadcastToProviders(r *Registry, req *internal.Request) {
+	data, _ := json.Marshal(req)
+	for _, provider := range r.Providers() {
+		provider.Send(data)
 	}
+}
 
-	pick := rand.Intn(len(c))
-	for _, provider := range c {
-		if pick == 0 {
-			err := provider.WriteMessage(websocket.TextMessage, data)
-			if err != nil {
-				return err
-			}
-			return nil
-		}
-		pick--
-	}
-	return nil
+// send the request to the client it is for, measuring it on the way
+func broadcastToClient(r *Registry, req *internal.Request) error {
+	observeReply(req)
+	return sendToClient(r, req)
 }
 
-func broadcastToClient(c map[string]*websocket.Conn, req *internal.Request) error {
+// send the request to the client it is for, without the ID the relay gave
+// it if the client sent none
+func sendToClient(r *Registry, req *internal.Request) error {
+	if strings.HasPrefix(req.ID, anonymousPrefix) {
+		res := *req
+		res.ID = ""
+		req = &res
+	}
 	data, err := json.Marshal(req)
 	if err != nil {
 		return err
 	}
 
-	if c[req.Tag] == nil {
+	client := r.Client(req.Tag)
+	if client == nil {
 		return nil
 	}
 
-	err = c[req.Tag].WriteMessage(websocket.TextMessage, data)
-	if err != nil {
-		return err
-	}
-	return nil
+	return client.Send(data)
 }
 
 // broadcast to all connections and return false if >= 1 failure
-func broadcastAll(c map[string]*websocket.Conn, req *internal.Request) bool {
+func broadcastAll(conns []*Conn, req *internal.Request) bool {
 	data, _ := json.Marshal(req)
 
 	ok := true
-	for tag, conn := range c {
-		err := conn.WriteMessage(websocket.TextMessage, data)
-		if err != nil {
-			delete(c, tag)
+	for _, conn := range conns {
+		if err := conn.Send(data); err != nil {
 			ok = false
 		}
 	}
@@ -72,21 +64,15 @@ func broadcastAll(c map[string]*websocket.Conn, req *internal.Request) bool {
 }
 
 // broadcast number of clients and providers to all clients
-func broadcastConnectionStats(clients map[string]*websocket.Conn, providers map[string]*websocket.Conn) {
-	retry_remaining := 3
-	ok := true
-	for retry_remaining > 0 {
-		ok = ok && broadcastAll(clients, &internal.Request{
-			Action: "clients",
-			Data:   strconv.Itoa(len(clients)),
-		})
-		ok = ok && broadcastAll(clients, &internal.Request{
-			Action: "providers",
-			Data:   strconv.Itoa(len(providers)),
-		})
-		if ok {
-			break
-		}
-		retry_remaining--
-	}
+func broadcastConnectionStats(r *Registry) {
+	clients, providers := r.Counts()
+	conns := r.Clients()
+	broadcastAll(conns, &internal.Request{
+		Action: "clients",
+		Data:   strconv.Itoa(clients),
+	})
+	broadcastAll(conns, &internal.Request{
+		Action: "providers",
+		Data:   strconv.Itoa(providers),
+	})
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ivynya/illm/internal/config"
+)
+
+// how often the config file is checked for changes
+const configPollPeriod = time.Second * 5
+
+// Config is everything the relay can be configured with. Users, rate
+// limits, the balancer, the queue depth, the image limit, the admin login
+// and the provider allow-list apply to a running server when the file
+// changes or on SIGHUP. The rest needs a restart.
+type Config struct {
+	Listen            string    `yaml:"listen"`
+	Username          string    `yaml:"username"`
+	Password          string    `yaml:"password"`
+	UsersFile         string    `yaml:"users_file"`
+	Balancer          string    `yaml:"balancer"`
+	MaxQueueDepth     int       `yaml:"max_queue_depth"`
+	MaxImageBytes     int       `yaml:"max_image_bytes"`
+	ProviderAllowlist []string  `yaml:"provider_allowlist"`
+	RateLimits        Limits    `yaml:"rate_limits"`
+	TLS               TLSConfig `yaml:"tls"`
+}
+
+type TLSConfig struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"`
+	ACME     struct {
+		Domains []string `yaml:"domains"`
+		Email   string   `yaml:"email"`
+		Cache   string   `yaml:"cache"`
+	} `yaml:"acme"`
+}
+
+func defaultConfig() *Config {
+	c := &Config{
+		Listen:        ":3000",
+		UsersFile:     "users.json",
+		Balancer:      "random",
+		MaxQueueDepth: defaultMaxQueueDepth,
+		MaxImageBytes: defaultMaxImageBytes,
+	}
+	c.TLS.ACME.Cache = defaultACMECache
+	return c
+}
+
+// every setting's environment variable and flag
+var settings = []config.Setting[Config]{
+	setting("LISTEN_ADDR", "listen", "`address` to listen on", func(c *Config) any { return &c.Listen }),
+	setting("USERNAME", "", "", func(c *Config) any { return &c.Username }),
+	setting("PASSWORD", "", "", func(c *Config) any { return &c.Password }),
+	setting("USERS_FILE", "users-file", "API key store `file`", func(c *Config) any { return &c.UsersFile }),
+	setting("BALANCER", "balancer", "`strategy`: random, least-outstanding, weighted or latency", func(c *Config) any { return &c.Balancer }),
+	setting("MAX_QUEUE_DEPTH", "max-queue-depth", "queued `requests` allowed per model", func(c *Config) any { return &c.MaxQueueDepth }),
+	setting("MAX_IMAGE_BYTES", "max-image-bytes", "total image `bytes` allowed per request", func(c *Config) any { return &c.MaxImageBytes }),
+	setting("PROVIDER_ALLOWLIST", "provider-allowlist", "comma separated `users` providers may authenticate as, by API key user or certificate common name", func(c *Config) any { return &c.ProviderAllowlist }),
+	setting("RATE_LIMIT_RPM", "rate-limit-rpm", "`requests` per minute per user", func(c *Config) any { return &c.RateLimits.PerMinute }),
+	setting("RATE_LIMIT_CONCURRENT", "rate-limit-concurrent", "`requests` at once per user", func(c *Config) any { return &c.RateLimits.Concurrent }),
+	setting("RATE_LIMIT_DAILY_TOKENS", "rate-limit-daily-tokens", "`tokens` per user per UTC day", func(c *Config) any { return &c.RateLimits.DailyTokens }),
+	setting("TLS_CERT", "tls-cert", "certificate PEM `file`", func(c *Config) any { return &c.TLS.Cert }),
+	setting("TLS_KEY", "tls-key", "certificate key PEM `file`", func(c *Config) any { return &c.TLS.Key }),
+	setting("TLS_CLIENT_CA", "tls-client-ca", "CA PEM `file` provider certificates must be signed by", func(c *Config) any { return &c.TLS.ClientCA }),
+	setting("ACME_DOMAINS", "acme-domains", "comma separated `domains` to get certificates for from Let's Encrypt", func(c *Config) any { return &c.TLS.ACME.Domains }),
+	setting("ACME_EMAIL", "acme-email", "contact `email` for the ACME account", func(c *Config) any { return &c.TLS.ACME.Email }),
+	setting("ACME_CACHE", "acme-cache", "`directory` to cache ACME certificates in", func(c *Config) any { return &c.TLS.ACME.Cache }),
+}
+
+func setting(env string, flag string, usage string, field func(c *Config) any) config.Setting[Config] {
+	return config.Setting[Config]{Env: env, Flag: flag, Usage: usage, Field: field}
+}
+
+func newLoader() *config.Loader[Config] {
+	return &config.Loader[Config]{Defaults: defaultConfig, Settings: settings}
+}
+
+// load and validate the config
+func loadConfig(loader *config.Loader[Config]) (*Config, error) {
+	c, err := loader.Load()
+	if err != nil {
+		return nil, err
+	}
+	return c, c.validate()
+}
+
+// validate reports everything wrong with the config at once
+func (c *Config) validate() error {
+	p := config.Problems{}
+
+	_, port, err := net.SplitHostPort(c.Listen)
+	p.Check(err == nil, "listen: %q is not host:port", c.Listen)
+	if err == nil {
+		n, err := strconv.Atoi(port)
+		p.Check(err == nil && n >= 0 && n <= 65535, "listen: %q is not a port", port)
+	}
+	p.Check((c.Username == "") == (c.Password == ""), "username and password must be set together")
+	p.Check(c.UsersFile != "", "users_file must be set")
+	_, err = newBalancer(c.Balancer)
+	p.Check(err == nil, "balancer: %v, choose random, least-outstanding, weighted or latency", err)
+	p.Check(c.MaxQueueDepth >= 0, "max_queue_depth must not be negative")
+	p.Check(c.MaxImageBytes >= 0, "max_image_bytes must not be negative")
+	p.Check(c.RateLimits.PerMinute >= 0, "rate_limits.per_minute must not be negative")
+	p.Check(c.RateLimits.Concurrent >= 0, "rate_limits.concurrent must not be negative")
+	p.Check(c.RateLimits.DailyTokens >= 0, "rate_limits.daily_tokens must not be negative")
+
+	t := c.TLS
+	p.Check((t.Cert == "") == (t.Key == ""), "tls.cert and tls.key must be set together")
+	p.Check(t.Cert == "" || len(t.ACME.Domains) == 0, "set either tls.cert and tls.key or tls.acme.domains, not both")
+	p.Check(t.ClientCA == "" || t.Cert != "" || len(t.ACME.Domains) > 0, "tls.client_ca needs tls.cert and tls.key or tls.acme.domains")
+	for name, path := range map[string]string{"tls.cert": t.Cert, "tls.key": t.Key, "tls.client_ca": t.ClientCA} {
+		if path != "" {
+			_, err := os.Stat(path)
+			p.Check(err == nil, "%s: %v", name, err)
+		}
+	}
+	return p.Err()
+}
+
+// restartOnly is the part of the config a reload can't change
+func (c *Config) restartOnly() any {
+	return []any{c.Listen, c.TLS}
+}
+
+// apply the settings that can change while running. The balancer is only
+// replaced when it changes, so it keeps its state otherwise.
+func (c *Config) apply(previous *Config, users *Users, dispatcher *Dispatcher, limiter *Limiter, relay *Relay) {
+	setAdmin(c.Username, c.Password)
+	if err := users.SetPath(c.UsersFile); err != nil {
+		log.Println("users_file:", err)
+	}
+	limiter.SetLimits(c.RateLimits)
+	relay.configure(c.MaxImageBytes, c.ProviderAllowlist)
+
+	var balancer Balancer
+	if previous.Balancer != c.Balancer {
+		balancer, _ = newBalancer(c.Balancer)
+	}
+	dispatcher.Configure(balancer, c.MaxQueueDepth)
+}
+
+// watchConfig reloads the config file when it changes or on SIGHUP and
+// calls apply with the previous and each valid new config. An invalid
+// file is logged and the running config kept.
+func watchConfig(loader *config.Loader[Config], current *Config, apply func(previous *Config, c *Config)) {
+	running := current.restartOnly()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(configPollPeriod)
+	defer ticker.Stop()
+
+	modified := modTime(loader.Path())
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			m := modTime(loader.Path())
+			if m.Equal(modified) {
+				continue
+			}
+			modified = m
+		}
+
+		c, err := loadConfig(loader)
+		if err != nil {
+			log.Println("config reload:", err)
+			continue
+		}
+		if !reflect.DeepEqual(c.restartOnly(), running) {
+			log.Println("config reload: listen and tls changes apply after a restart")
+		}
+		apply(current, c)
+		current = c
+		log.Println("config reloaded")
+	}
+}
+
+// when the file at path was last modified, zero if there is none
+func modTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/ivynya/illm/internal"
+)
+
+// Dispatcher sends client requests to providers. While every provider that
+// could serve a model is at its concurrency limit, requests for that model
+// wait in a queue and their clients are told where they are in it.
+type Dispatcher struct {
+	registry *Registry
+	ended    func(req *internal.Request) // called when the dispatcher fails a request, if set
+
+	mu       sync.Mutex
+	balancer Balancer
+	maxDepth int
+	queues   map[string][]*internal.Request // by normalized model
+	inflight map[string][]*flight           // by request key
+}
+
+// a request a provider is running
+type flight struct {
+	provider *Provider
+	req      *internal.Request
+}
+
+func NewDispatcher(r *Registry, b Balancer, maxDepth int) *Dispatcher {
+	return &Dispatcher{
+		registry: r,
+		balancer: b,
+		maxDepth: maxDepth,
+		queues:   make(map[string][]*internal.Request),
+		inflight: make(map[string][]*flight),
+	}
+}
+
+// Configure changes the balancer, unless b is nil, and the queue depth.
+// Requests already queued stay queued even if there are now more of them
+// than maxDepth.
+func (d *Dispatcher) Configure(b Balancer, maxDepth int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if b != nil {
+		d.balancer = b
+	}
+	d.maxDepth = maxDepth
+}
+
+// Dispatch sends the request to a provider with a free slot, queues it,
+// or tells the client why it can't be served. An error means the client
+// couldn't be told.
+func (d *Dispatcher) Dispatch(req *internal.Request) error {
+	model := normalizeModel(req.Generate.Model)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	providers := d.candidates(req)
+	if len(providers) == 0 {
+		kind := "model "
+		if req.Action == "embed" {
+			kind = "embedding model "
+		}
+		who := "No provider"
+		if req.Sealed != nil {
+			who = "No provider with key " + req.Sealed.Key
+		}
+		return d.fail(req, internal.ErrModelUnavailable, who+" has "+kind+req.Generate.Model+" installed")
+	}
+
+	if len(d.queues[model]) == 0 {
+		if available := withFreeSlot(providers); len(available) > 0 {
+			if err := d.send(d.balancer.Pick(available), req); err != nil {
+				return d.fail(req, internal.ErrProviderUnavailable, "Provider disconnected")
+			}
+			return nil
+		}
+	}
+
+	if len(d.queues[model]) >= d.maxDepth {
+		return d.fail(req, internal.ErrQueueFull,
+			fmt.Sprintf("All providers for %s are busy and the queue is full", req.Generate.Model))
+	}
+	d.queues[model] = append(d.queues[model], req)
+	return d.notify(model, len(d.queues[model])-1)
+}
+
+// QueueDepths returns how many requests are waiting for each model
+func (d *Dispatcher) QueueDepths() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	depths := make(map[string]int, len(d.queues))
+	for model, queue := range d.queues {
+		depths[model] = len(queue)
+	}
+	return depths
+}
+
+// Finished is called when a provider completes or fails a request, freeing
+// a slot for whatever is queued on its models. It reports whether the
+// provider was running the request at all.
+func (d *Dispatcher) Finished(p *Provider, req *internal.Request) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.land(p, req.Key()) == nil {
+		return false
+	}
+	p.finished()
+	for _, model := range p.Models() {
+		d.drain(model)
+	}
+	return true
+}
+
+// Running reports whether the request with key was sent to p and hasn't
+// finished yet
+func (d *Dispatcher) Running(p *Provider, key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, f := range d.inflight[key] {
+		if f.provider == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Cancel stops a request. A queued request is dropped and its client told
+// so; a running one is cancelled by its provider, which answers with a
+// cancelled error like any other failure. A cancel without an ID stops
+// every request its client sent without one.
+func (d *Dispatcher) Cancel(req *internal.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	matches := func(other *internal.Request) bool {
+		return other.Key() == req.Key()
+	}
+	if req.ID == "" {
+		matches = func(other *internal.Request) bool {
+			return other.Tag == req.Tag && strings.HasPrefix(other.ID, anonymousPrefix)
+		}
+	}
+	for model, queue := range d.queues {
+		kept := queue[:0]
+		for _, queued := range queue {
+			if !matches(queued) {
+				kept = append(kept, queued)
+				continue
+			}
+			d.fail(queued, internal.ErrCancelled, "Request cancelled")
+		}
+		if len(kept) != len(queue) {
+			d.setQueue(model, kept)
+			d.notify(model, 0)
+		}
+	}
+
+	for _, flights := range d.inflight {
+		for _, f := range flights {
+			if matches(f.req) {
+				d.cancel(f)
+			}
+		}
+	}
+}
+
+// Joined is called when a provider handshakes, so queued requests for its
+// models can start on it. A provider may hand shake again without a model,
+// so requests queued for models nobody serves any more are failed.
+func (d *Dispatcher) Joined(p *Provider) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, model := range p.Models() {
+		d.drain(model)
+	}
+	d.failOrphans(internal.ErrModelUnavailable, "Provider no longer has the model installed")
+}
+
+// Left is called when a provider disconnects. Requests it was running and
+// requests queued for models nobody else serves are failed rather than
+// left waiting forever.
+func (d *Dispatcher) Left(p *Provider) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var lost []*flight
+	for _, flights := range d.inflight {
+		for _, f := range flights {
+			if f.provider == p {
+				lost = append(lost, f)
+			}
+		}
+	}
+	for _, f := range lost {
+		d.land(p, f.req.Key())
+		d.fail(f.req, internal.ErrProviderUnavailable, "Provider disconnected")
+	}
+	d.failOrphans(internal.ErrProviderUnavailable, "Provider disconnected")
+}
+
+// RemoveClient drops everything a disconnected client had queued and asks
+// providers to stop what they are running for it. Running requests end
+// when their providers answer the cancel.
+func (d *Dispatcher) RemoveClient(tag string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, flights := range d.inflight {
+		for _, f := range flights {
+			if f.req.Tag == tag {
+				d.cancel(f)
+			}
+		}
+	}
+	for model, queue := range d.queues {
+		kept := queue[:0]
+		for _, req := range queue {
+			if req.Tag != tag {
+				kept = append(kept, req)
+			} else if d.ended != nil {
+				d.ended(req)
+			}
+		}
+		if len(kept) == len(queue) {
+			continue
+		}
+		d.setQueue(model, kept)
+		d.notify(model, 0)
+	}
+}
+
+// start as many queued requests for model as there are free slots, d.mu
+// must be held
+func (d *Dispatcher) drain(model string) {
+	started := false
+	for len(d.queues[model]) > 0 {
+		req := d.queues[model][0]
+		available := withFreeSlot(d.candidates(req))
+		if len(available) == 0 {
+			break
+		}
+		d.setQueue(model, d.queues[model][1:])
+		started = true
+
+		if err := d.send(d.balancer.Pick(available), req); err != nil {
+			d.fail(req, internal.ErrProviderUnavailable, "Provider disconnected")
+		}
+	}
+	if started {
+		d.notify(model, 0)
+	}
+}
+
+// fail queued requests that no connected provider can serve any more,
+// d.mu must be held
+func (d *Dispatcher) failOrphans(code string, message string) {
+	for model, queue := range d.queues {
+		kept := queue[:0]
+		for _, req := range queue {
+			if len(d.candidates(req)) > 0 {
+				kept = append(kept, req)
+				continue
+			}
+			d.fail(req, code, message)
+		}
+		if len(kept) != len(queue) {
+			d.setQueue(model, kept)
+			d.notify(model, 0)
+		}
+	}
+}
+
+// tell the client its request failed, which is the end of it
+func (d *Dispatcher) fail(req *internal.Request, code string, message string) error {
+	if d.ended != nil {
+		d.ended(req)
+	}
+	return broadcastToClient(d.registry, internal.NewError(req, code, message))
+}
+
+func (d *Dispatcher) setQueue(model string, queue []*internal.Request) {
+	if len(queue) == 0 {
+		delete(d.queues, model)
+		return
+	}
+	d.queues[model] = queue
+}
+
+// send a request to a provider and count it against the provider's limit
+func (d *Dispatcher) send(p *Provider, req *internal.Request) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	err = p.Send(data)
+	if err != nil {
+		return err
+	}
+	p.started()
+	key := req.Key()
+	d.inflight[key] = append(d.inflight[key], &flight{provider: p, req: req})
+	return nil
+}
+
+// forget one request with key running on p, d.mu must be held
+func (d *Dispatcher) land(p *Provider, key string) *flight {
+	flights := d.inflight[key]
+	for i, f := range flights {
+		if f.provider != p {
+			continue
+		}
+		flights = append(flights[:i], flights[i+1:]...)
+		if len(flights) == 0 {
+			delete(d.inflight, key)
+		} else {
+			d.inflight[key] = flights
+		}
+		return f
+	}
+	return nil
+}
+
+// ask the provider running a request to stop it
+func (d *Dispatcher) cancel(f *flight) {
+	data, _ := json.Marshal(&internal.Request{
+		Tag:    f.req.Tag,
+		ID:     f.req.ID,
+		Action: "cancel",
+	})
+	f.provider.Send(data)
+}
+
+// tell every client queued for model from position from onwards where it
+// is in the queue and roughly how long it will wait, d.mu must be held
+func (d *Dispatcher) notify(model string, from int) error {
+	providers := d.registry.ProvidersFor(model)
+	slots, avg := 0, 0.0
+	measured := 0
+	for _, p := range providers {
+		slots += p.Concurrency()
+		if duration := p.AverageDuration(); duration > 0 {
+			avg += duration.Seconds()
+			measured++
+		}
+	}
+	if measured > 0 {
+		avg /= float64(measured)
+	}
+
+	var err error
+	for i := from; i < len(d.queues[model]); i++ {
+		req := d.queues[model][i]
+		status := &internal.QueueStatus{Position: i + 1}
+		if slots > 0 {
+			status.ETA = int(math.Ceil(float64(i/slots+1) * avg))
+		}
+		err = broadcastToClient(d.registry, &internal.Request{
+			Tag:    req.Tag,
+			ID:     req.ID,
+			Action: "queued",
+			Data:   fmt.Sprintf("Queued at position %d", status.Position),
+			Queue:  status,
+		})
+	}
+	return err
+}
+
+// providers that can serve a request, whether or not they are busy. A
+// sealed request can only go to the provider whose key it is sealed to.
+func (d *Dispatcher) candidates(req *internal.Request) []*Provider {
+	providers := d.registry.ProvidersFor(req.Generate.Model)
+	if req.Action != "embed" && req.Sealed == nil {
+		return providers
+	}
+	matching := providers[:0]
+	for _, p := range providers {
+		if req.Action == "embed" && !p.CanEmbed(req.Generate.Model) {
+			continue
+		}
+		if req.Sealed != nil && p.Fingerprint() != req.Sealed.Key {
+			continue
+		}
+		matching = append(matching, p)
+	}
+	return matching
+}
+
+// providers that are running fewer requests than their advertised limit
+func withFreeSlot(providers []*Provider) []*Provider {
+	available := make([]*Provider, 0, len(providers))
+	for _, p := range providers {
+		if p.Outstanding() < p.Concurrency() {
+			available = append(available, p)
+		}
+	}
+	return available
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ivynya/illm/internal"
+)
+
+// the last queue status the client was sent for the request with id
+func lastQueued(ws *fakeSocket, id string) *internal.QueueStatus {
+	var status *internal.QueueStatus
+	for _, req := range ws.requests() {
+		if req.Action == "queued" && req.ID == id {
+			status = req.Queue
+		}
+	}
+	return status
+}
+
+// send a generate request for each id, and wait for the first running
+// ones to reach the provider
+func fill(t *testing.T, r *Relay, client *Conn, providerWS *fakeSocket, running int, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		r.fromClient(testGenerate(client, id, "llama3"))
+	}
+	providerWS.waitFor(t, "generate", running)
+}
+
+func TestQueueFull(t *testing.T) {
+	r := newTestRelay(Limits{})
+	r.dispatcher.Configure(nil, 2)
+	client, clientWS := addTestClient(t, r, "alice")
+	_, providerWS := addTestProvider(t, r, "box", 1, "llama3")
+
+	fill(t, r, client, providerWS, 1, "1", "2", "3", "4")
+	failed := clientWS.waitFor(t, "error", 1)
+	if len(failed) != 1 || failed[0].ID != "4" || failed[0].Error.Code != internal.ErrQueueFull {
+		t.Fatalf("got %+v, want queue_full for 4 only", failed[0])
+	}
+	if depth := r.dispatcher.QueueDepths()["llama3:latest"]; depth != 2 {
+		t.Fatalf("queue depth %d, want 2", depth)
+	}
+	if n := len(providerWS.requests()); n != 1 {
+		t.Fatalf("provider was sent %d requests over its concurrency of 1", n)
+	}
+}
+
+// Waiting clients are told their place in the queue and, once providers
+// have finished something, roughly how long they will wait
+func TestQueuedPositionAndETA(t *testing.T) {
+	r := newTestRelay(Limits{})
+	client, clientWS := addTestClient(t, r, "alice")
+	provider, providerWS := addTestProvider(t, r, "box", 2, "llama3")
+
+	// A first request that took a second sets the provider's average
+	fill(t, r, client, providerWS, 1, "first")
+	r.fromProvider(provider, testResponse(providerWS.waitFor(t, "generate", 1)[0], true, 5))
+
+	fill(t, r, client, providerWS, 3, "1", "2", "3", "4", "5")
+	clientWS.waitFor(t, "queued", 3)
+	tests := []struct {
+		id       string
+		position int
+		eta      int
+	}{
+		// two slots, so the first two in line start after one request
+		{"3", 1, 1},
+		{"4", 2, 1},
+		{"5", 3, 2},
+	}
+	for _, tt := range tests {
+		status := lastQueued(clientWS, tt.id)
+		if status == nil || status.Position != tt.position || status.ETA != tt.eta {
+			t.Errorf("request %s: got %+v, want position %d and ETA %d", tt.id, status, tt.position, tt.eta)
+		}
+	}
+}
+
+func TestQueueDrains(t *testing.T) {
+	tests := []struct {
+		name string
+		// free a slot, returning the socket of the provider it is on
+		free func(t *testing.T, r *Relay, provider *Provider, providerWS *fakeSocket) *fakeSocket
+	}{
+		{"when a request finishes", func(t *testing.T, r *Relay, provider *Provider, providerWS *fakeSocket) *fakeSocket {
+			r.fromProvider(provider, testResponse(providerWS.requests()[0], true, 5))
+			return providerWS
+		}},
+		{"when a provider joins", func(t *testing.T, r *Relay, provider *Provider, providerWS *fakeSocket) *fakeSocket {
+			_, ws := addTestProvider(t, r, "other", 1, "llama3")
+			return ws
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRelay(Limits{})
+			client, clientWS := addTestClient(t, r, "alice")
+			provider, providerWS := addTestProvider(t, r, "box", 1, "llama3")
+			fill(t, r, client, providerWS, 1, "1", "2", "3")
+			clientWS.waitFor(t, "queued", 2)
+
+			ws := tt.free(t, r, provider, providerWS)
+			eventually(t, func() bool {
+				started := ws.requests()
+				return len(started) > 0 && started[len(started)-1].ID == "2"
+			}, "the first in line to start")
+			if depth := r.dispatcher.QueueDepths()["llama3:latest"]; depth != 1 {
+				t.Fatalf("queue depth %d, want 1", depth)
+			}
+			// The one still waiting is told it moved up
+			eventually(t, func() bool {
+				status := lastQueued(clientWS, "3")
+				return status != nil && status.Position == 1
+			}, "request 3 to move up the queue")
+		})
+	}
+}
+
+// A provider that disconnects fails what it was running, and what was
+// queued for it if nobody else serves the model
+func TestProviderLeftFailsQueued(t *testing.T) {
+	r := newTestRelay(Limits{})
+	client, clientWS := addTestClient(t, r, "alice")
+	provider, providerWS := addTestProvider(t, r, "box", 1, "llama3")
+	_, otherWS := addTestProvider(t, r, "other", 1, "mistral")
+	fill(t, r, client, providerWS, 1, "1", "2")
+	r.fromClient(testGenerate(client, "3", "mistral"))
+	otherWS.waitFor(t, "generate", 1)
+	clientWS.waitFor(t, "queued", 1)
+
+	r.providerLeft(provider)
+	failed := map[string]string{}
+	for _, res := range clientWS.waitFor(t, "error", 2) {
+		failed[res.ID] = res.Error.Code
+	}
+	for _, id := range []string{"1", "2"} {
+		if failed[id] != internal.ErrProviderUnavailable {
+			t.Errorf("request %s: got %q, want provider_unavailable", id, failed[id])
+		}
+	}
+	if _, ok := failed["3"]; ok {
+		t.Error("request running on another provider was failed")
+	}
+	if depths := r.dispatcher.QueueDepths(); len(depths) != 0 {
+		t.Fatalf("queue depths %v, want none", depths)
+	}
+}
+
+// A provider that hands shake again without a model fails what is queued
+// for it if nobody else serves that model
+func TestHandshakeWithoutModelFailsQueued(t *testing.T) {
+	r := newTestRelay(Limits{})
+	client, clientWS := addTestClient(t, r, "alice")
+	provider, providerWS := addTestProvider(t, r, "box", 1, "llama3")
+
+	r.fromClient(testGenerate(client, "1", "llama3"))
+	providerWS.waitFor(t, "generate", 1)
+	r.fromClient(testGenerate(client, "2", "llama3"))
+	clientWS.waitFor(t, "queued", 1)
+
+	r.fromProvider(provider, &internal.Request{
+		Action:    "handshake",
+		Handshake: &internal.Handshake{Identifier: "box", Models: []string{"mistral"}, Concurrency: 1},
+	})
+	failed := clientWS.waitFor(t, "error", 1)[0]
+	if failed.ID != "2" || failed.Error.Code != internal.ErrModelUnavailable {
+		t.Fatalf("got %s %+v, want model_unavailable for 2", failed.ID, failed.Error)
+	}
+	if depths := r.dispatcher.QueueDepths(); len(depths) != 0 {
+		t.Fatalf("queue depths %v, want none", depths)
+	}
+}
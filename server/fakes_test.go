@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ivynya/illm/internal"
+)
+
+// fakeSocket stands in for a websocket, keeping what is written to it
+type fakeSocket struct {
+	mu       sync.Mutex
+	messages [][]byte
+	closed   bool
+	fail     bool // fail every write, like a dead connection
+}
+
+func (s *fakeSocket) WriteMessage(messageType int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.fail {
+		return errors.New("fake socket closed")
+	}
+	s.messages = append(s.messages, data)
+	return nil
+}
+
+func (s *fakeSocket) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *fakeSocket) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// deadlineSocket is a fakeSocket with deadlines, like a real websocket
+type deadlineSocket struct {
+	fakeSocket
+	readDeadline time.Time
+}
+
+func (s *deadlineSocket) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = t
+	return nil
+}
+
+func (s *deadlineSocket) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (s *deadlineSocket) deadline() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readDeadline
+}
+
+// the messages written so far, decoded
+func (s *fakeSocket) requests() []*internal.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := make([]*internal.Request, 0, len(s.messages))
+	for _, data := range s.messages {
+		req := &internal.Request{}
+		if json.Unmarshal(data, req) == nil {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+// wait for n messages with the action to be written
+func (s *fakeSocket) waitFor(t *testing.T, action string, n int) []*internal.Request {
+	t.Helper()
+	var found []*internal.Request
+	eventually(t, func() bool {
+		found = found[:0]
+		for _, req := range s.requests() {
+			if req.Action == action {
+				found = append(found, req)
+			}
+		}
+		return len(found) >= n
+	}, "%d %s messages, got %d", n, action, len(found))
+	return found
+}
+
+// eventually fails the test unless cond becomes true within a second
+func eventually(t *testing.T, cond func() bool, format string, args ...any) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for "+format, args...)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+// a relay wired up the way main does it
+func newTestRelay(limits Limits) *Relay {
+	registry := NewRegistry()
+	dispatcher := NewDispatcher(registry, randomBalancer{}, defaultMaxQueueDepth)
+	limiter := NewLimiter(limits)
+	dispatcher.ended = func(req *internal.Request) {
+		limiter.Release(req.Key())
+	}
+	relay := &Relay{registry: registry, dispatcher: dispatcher, limiter: limiter}
+	relay.configure(defaultMaxImageBytes, nil)
+	return relay
+}
+
+// connect a fake client for user
+func addTestClient(t *testing.T, r *Relay, user string) (*Conn, *fakeSocket) {
+	t.Helper()
+	ws := &fakeSocket{}
+	c, err := r.registry.AddClient(ws, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, ws
+}
+
+// connect a fake provider serving models, and have it hand shake
+func addTestProvider(t *testing.T, r *Relay, identifier string, concurrency int, models ...string) (*Provider, *fakeSocket) {
+	t.Helper()
+	ws := &fakeSocket{}
+	p, err := r.registry.AddProvider(ws, "provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.fromProvider(p, &internal.Request{
+		Action:    "handshake",
+		Handshake: &internal.Handshake{Identifier: identifier, Models: models, Concurrency: concurrency},
+	})
+	return p, ws
+}
+
+// a generate request from a client
+func testGenerate(c *Conn, id string, model string) *internal.Request {
+	req := &internal.Request{Tag: c.Tag, ID: id, User: c.User, Action: "generate"}
+	req.Generate.Model = model
+	req.Generate.Prompt = "hello"
+	return req
+}
+
+// a provider's reply to req, the final one if done
+func testResponse(req *internal.Request, done bool, evalCount int) *internal.Request {
+	res := &internal.Request{Tag: req.Tag, ID: req.ID, Action: "response", Data: `{"response":"hi","done":false}`}
+	if done {
+		data, _ := json.Marshal(map[string]any{
+			"done":              true,
+			"prompt_eval_count": 0,
+			"eval_count":        evalCount,
+			"eval_duration":     int64(time.Second),
+			"total_duration":    int64(time.Second),
+		})
+		res.Data = string(data)
+	}
+	return res
+}
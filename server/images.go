@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/ivynya/illm/internal"
+)
+
+// total decoded size of the images on one request when MAX_IMAGE_BYTES
+// is unset
+const defaultMaxImageBytes = 10 << 20
+
+// check the images attached to a request fit within limit bytes, so one
+// client can't push huge uploads through the relay to a provider
+func checkImages(req *internal.Request, limit int) error {
+	total := 0
+	for _, image := range req.Images() {
+		total += base64.StdEncoding.DecodedLen(len(image))
+	}
+	if total > limit {
+		return fmt.Errorf("Images are %d bytes, the limit is %d", total, limit)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const keysUsage = `usage:
+  server keys create [-role client|provider|admin] <user>
+                              create an API key for user and print it
+  server keys revoke <id>     revoke the key with the given id
+  server keys list            list keys`
+
+// manage API keys from the command line
+func runKeys(users *Users, args []string) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+
+	switch {
+	case args[0] == "create":
+		flags := flag.NewFlagSet("create", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		role := flags.String("role", roleClient, "")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 1 {
+			return errors.New(keysUsage)
+		}
+		if !validRole(*role) {
+			return errors.New("role must be admin, client or provider")
+		}
+		token, key, err := users.Create(flags.Arg(0), *role)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created %s key %s for %s, it will not be shown again:\n%s\n", key.Role, key.ID, key.User, token)
+	case args[0] == "revoke" && len(args) == 2:
+		if err := users.Revoke(args[1]); err != nil {
+			return err
+		}
+		fmt.Println("revoked key", args[1])
+	case args[0] == "list" && len(args) == 1:
+		keys, err := users.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSER\tROLE\tCREATED")
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.ID, key.User, key.role(), key.Created.Format(time.RFC3339))
+		}
+		w.Flush()
+	default:
+		return errors.New(keysUsage)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// how long a user over the concurrency limit is told to wait, since there
+// is no telling when one of their requests will finish
+const concurrentRetryAfter = time.Second * 5
+
+// Limits caps what each user may ask of the providers. Zero means
+// unlimited.
+type Limits struct {
+	PerMinute   int `yaml:"per_minute"`   // requests started in any minute
+	Concurrent  int `yaml:"concurrent"`   // requests queued or running at once
+	DailyTokens int `yaml:"daily_tokens"` // prompt and generated tokens per UTC day
+}
+
+// Limiter enforces Limits per user. Requests are admitted when they arrive
+// and released when they end however they end. Tokens are charged as
+// generations finish, and a generation that stops early is charged for
+// what it streamed, so cancelling doesn't make work free.
+type Limiter struct {
+	mu     sync.Mutex
+	limits Limits
+	users  map[string]*usage
+	active map[string]*admission // by request key
+}
+
+// an admitted request that hasn't ended
+type admission struct {
+	user     string
+	streamed int // response frames so far, about one token each
+}
+
+var errDuplicateRequest = errors.New("A request with this ID is already running")
+
+type usage struct {
+	recent []time.Time // start times within the last minute
+	active int
+	day    string
+	tokens int
+}
+
+// limitError is why a request was refused and when to try again
+type limitError struct {
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *limitError) Error() string {
+	return e.message
+}
+
+// retry after in whole seconds, rounded up
+func (e *limitError) seconds() int {
+	return int((e.retryAfter + time.Second - 1) / time.Second)
+}
+
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{
+		limits: limits,
+		users:  make(map[string]*usage),
+		active: make(map[string]*admission),
+	}
+}
+
+// SetLimits changes the limits. Usage so far is kept and counts against
+// the new limits.
+func (l *Limiter) SetLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+}
+
+func (l *Limiter) usage(user string, now time.Time) *usage {
+	u := l.users[user]
+	if u == nil {
+		u = &usage{}
+		l.users[user] = u
+	}
+	if day := now.UTC().Format(time.DateOnly); u.day != day {
+		u.day, u.tokens = day, 0
+	}
+	cutoff := now.Add(-time.Minute)
+	for len(u.recent) > 0 && !u.recent[0].After(cutoff) {
+		u.recent = u.recent[1:]
+	}
+	return u
+}
+
+// Admit counts a request against its user, or returns why it can't run: a
+// *limitError, or errDuplicateRequest if a request with the same key is
+// still running. Keys must be unique per request.
+func (l *Limiter) Admit(user string, key string) error {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.active[key]; ok {
+		return errDuplicateRequest
+	}
+	u := l.usage(user, now)
+
+	if l.limits.DailyTokens > 0 && u.tokens >= l.limits.DailyTokens {
+		y, m, d := now.UTC().Date()
+		midnight := time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+		return &limitError{
+			message:    fmt.Sprintf("Daily budget of %d tokens used up", l.limits.DailyTokens),
+			retryAfter: midnight.Sub(now),
+		}
+	}
+	if l.limits.PerMinute > 0 && len(u.recent) >= l.limits.PerMinute {
+		return &limitError{
+			message:    fmt.Sprintf("Limit of %d requests per minute reached", l.limits.PerMinute),
+			retryAfter: u.recent[0].Add(time.Minute).Sub(now),
+		}
+	}
+	if l.limits.Concurrent > 0 && u.active >= l.limits.Concurrent {
+		return &limitError{
+			message:    fmt.Sprintf("Limit of %d requests at once reached", l.limits.Concurrent),
+			retryAfter: concurrentRetryAfter,
+		}
+	}
+
+	u.recent = append(u.recent, now)
+	u.active++
+	l.active[key] = &admission{user: user}
+	return nil
+}
+
+// Progress records a response frame a provider streamed for a request
+func (l *Limiter) Progress(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if a := l.active[key]; a != nil {
+		a.streamed++
+	}
+}
+
+// Release ends a request that failed or was cancelled, charging what it
+// streamed before it stopped. Safe to call more than once.
+func (l *Limiter) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if a := l.active[key]; a != nil {
+		l.finish(key, a.streamed)
+	}
+}
+
+// Finish ends a request that completed, charging the tokens it used to
+// its user's budget
+func (l *Limiter) Finish(key string, tokens int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.finish(key, tokens)
+}
+
+func (l *Limiter) finish(key string, tokens int) {
+	a := l.active[key]
+	if a == nil {
+		return
+	}
+	delete(l.active, key)
+	u := l.usage(a.user, time.Now())
+	u.tokens += tokens
+	if u.active > 0 {
+		u.active--
+	}
+}
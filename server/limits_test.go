@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ivynya/illm/internal"
+)
+
+// the tokens charged to user today
+func tokensUsed(l *Limiter, user string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if u := l.users[user]; u != nil {
+		return u.tokens
+	}
+	return 0
+}
+
+func TestAdmitRejectsDuplicateKeys(t *testing.T) {
+	l := NewLimiter(Limits{})
+	if err := l.Admit("alice", "tag/1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Admit("alice", "tag/1"); !errors.Is(err, errDuplicateRequest) {
+		t.Fatalf("second admit of a running key: got %v, want errDuplicateRequest", err)
+	}
+	l.Finish("tag/1", 0)
+	if err := l.Admit("alice", "tag/1"); err != nil {
+		t.Fatalf("admit after the first finished: %v", err)
+	}
+}
+
+func TestAdmitLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		admit  int // requests admitted before the one refused
+	}{
+		{"per minute", Limits{PerMinute: 2}, 2},
+		{"concurrent", Limits{Concurrent: 3}, 3},
+		{"unlimited", Limits{}, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(tt.limits)
+			for i := 0; i < tt.admit; i++ {
+				if err := l.Admit("alice", anonymousID()); err != nil {
+					t.Fatalf("request %d: %v", i, err)
+				}
+			}
+			err := l.Admit("alice", anonymousID())
+			var limit *limitError
+			if tt.limits == (Limits{}) {
+				if err != nil {
+					t.Fatalf("unlimited: %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &limit) || limit.retryAfter <= 0 {
+				t.Fatalf("got %v, want a limitError with a retry after", err)
+			}
+			if err := l.Admit("bob", anonymousID()); err != nil {
+				t.Fatalf("other users are limited separately: %v", err)
+			}
+		})
+	}
+}
+
+func TestReleaseChargesStreamedWork(t *testing.T) {
+	l := NewLimiter(Limits{DailyTokens: 5})
+	l.Admit("alice", "tag/1")
+	for i := 0; i < 5; i++ {
+		l.Progress("tag/1")
+	}
+	l.Release("tag/1")
+	l.Release("tag/1")
+	if got := tokensUsed(l, "alice"); got != 5 {
+		t.Fatalf("charged %d tokens for a cancelled request, want 5", got)
+	}
+	var limit *limitError
+	if err := l.Admit("alice", "tag/2"); !errors.As(err, &limit) {
+		t.Fatalf("admit over the daily budget: got %v, want a limitError", err)
+	}
+}
+
+// Requests sent without an ID are told apart, so each counts against the
+// limits and each is charged when it ends
+func TestAnonymousRequestsAreLimitedSeparately(t *testing.T) {
+	r := newTestRelay(Limits{Concurrent: 2})
+	client, clientWS := addTestClient(t, r, "alice")
+	_, providerWS := addTestProvider(t, r, "box", 4, "llama3")
+
+	for i := 0; i < 3; i++ {
+		r.fromClient(testGenerate(client, "", "llama3"))
+	}
+	refused := clientWS.waitFor(t, "error", 1)
+	if refused[0].Error.Code != internal.ErrRateLimited || refused[0].ID != "" {
+		t.Fatalf("third request: got %+v, want rate_limited without an ID", refused[0].Error)
+	}
+
+	// Both running requests finish at once and are each charged
+	sent := providerWS.waitFor(t, "generate", 2)
+	if sent[0].ID == sent[1].ID {
+		t.Fatalf("both requests were sent with ID %q", sent[0].ID)
+	}
+	for _, req := range sent {
+		r.fromProvider(r.registry.Providers()[0], testResponse(req, true, 10))
+	}
+	if got := tokensUsed(r.limiter, "alice"); got != 20 {
+		t.Fatalf("charged %d tokens for two requests of 10, want 20", got)
+	}
+	for _, res := range clientWS.waitFor(t, "response", 2) {
+		if res.ID != "" {
+			t.Fatalf("client was sent the relay's ID %q", res.ID)
+		}
+	}
+}
+
+func TestReservedIDsAreRefused(t *testing.T) {
+	r := newTestRelay(Limits{})
+	client, clientWS := addTestClient(t, r, "alice")
+	r.fromClient(testGenerate(client, anonymousPrefix+"mine", "llama3"))
+	if res := clientWS.waitFor(t, "error", 1)[0]; res.Error.Code != internal.ErrInvalidRequest {
+		t.Fatalf("got %+v, want invalid_request", res.Error)
+	}
+}
+
+// A client that disconnects is still charged for what its requests
+// streamed, once their providers confirm they stopped
+func TestDisconnectChargesStreamedWork(t *testing.T) {
+	r := newTestRelay(Limits{})
+	client, _ := addTestClient(t, r, "alice")
+	provider, providerWS := addTestProvider(t, r, "box", 1, "llama3")
+
+	r.fromClient(testGenerate(client, "1", "llama3"))
+	req := providerWS.waitFor(t, "generate", 1)[0]
+	for i := 0; i < 3; i++ {
+		r.fromProvider(provider, testResponse(req, false, 0))
+	}
+	r.clientLeft(client)
+	providerWS.waitFor(t, "cancel", 1)
+
+	res := &internal.Request{Tag: req.Tag, ID: req.ID, Action: "error"}
+	res.Error = &internal.Error{Code: internal.ErrCancelled, Message: "Cancelled"}
+	r.fromProvider(provider, res)
+	if got := tokensUsed(r.limiter, "alice"); got != 3 {
+		t.Fatalf("charged %d tokens, want 3", got)
+	}
+}
+
+// Only the provider running a request can charge for it, and never with
+// negative counts that would refund its user
+func TestOnlyRunningProviderCharges(t *testing.T) {
+	r := newTestRelay(Limits{})
+	client, _ := addTestClient(t, r, "alice")
+	provider, providerWS := addTestProvider(t, r, "box", 1, "llama3")
+	other, _ := addTestProvider(t, r, "other", 1, "mistral")
+
+	r.fromClient(testGenerate(client, "1", "llama3"))
+	req := providerWS.waitFor(t, "generate", 1)[0]
+	r.fromProvider(other, testResponse(req, false, 0))
+	r.fromProvider(other, testResponse(req, true, 5000))
+	r.fromProvider(other, &internal.Request{Tag: req.Tag, ID: req.ID, Action: "error"})
+	if got := tokensUsed(r.limiter, "alice"); got != 0 {
+		t.Fatalf("another provider charged %d tokens", got)
+	}
+
+	refund := &internal.Request{Tag: req.Tag, ID: req.ID, Action: "response",
+		Data: `{"done":true,"prompt_eval_count":-100,"eval_count":-5000}`}
+	r.fromProvider(provider, refund)
+	if got := tokensUsed(r.limiter, "alice"); got != 0 {
+		t.Fatalf("negative counts charged %d tokens", got)
+	}
+	r.fromProvider(provider, testResponse(req, true, 7))
+	if got := tokensUsed(r.limiter, "alice"); got != 7 {
+		t.Fatalf("charged %d tokens, want 7", got)
+	}
+}
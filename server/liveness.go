@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+const (
+	// time allowed to write a message before the peer is considered gone
+	writeWait = time.Second * 10
+
+	// a peer that sends nothing, not even a pong, for this long is dead
+	pongWait = time.Second * 60
+
+	// how often peers are pinged, often enough to get a pong back in time
+	pingPeriod = pongWait * 9 / 10
+
+	// a provider's reported load is out of date once it has missed a
+	// heartbeat, which it sends every 45 seconds
+	heartbeatStale = time.Second * 90
+)
+
+// deadliner is implemented by real websockets, which are pinged and have
+// deadlines, but not by the sockets standing in for HTTP clients
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// watch the websocket of c for a half-open connection. Reads fail once the
+// peer has been silent for pongWait, which ends the handler's read loop
+// and removes the peer from the registry.
+func watch(ws *websocket.Conn, c *Conn) {
+	c.alive()
+	ws.SetPongHandler(func(string) error {
+		c.alive()
+		return nil
+	})
+}
+
+// push back the read deadline after hearing from the peer, unless the
+// connection was closed, since its past deadline is what ends the read loop
+func (c *Conn) alive() {
+	d, ok := c.ws.(deadliner)
+	if !ok {
+		return
+	}
+	c.closing.Lock()
+	defer c.closing.Unlock()
+	select {
+	case <-c.done:
+	default:
+		d.SetReadDeadline(time.Now().Add(pongWait))
+	}
+}
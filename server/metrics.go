@@ -0,0 +1,223 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/ivynya/illm/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Labels are kept to values the relay controls, so a client can't create
+// new series: models only when some provider serves them, error codes
+// only when they are known, and providers by their identifier.
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "illm_requests_total",
+		Help: "Requests that ended, by action, model and status (ok, an error code, or disconnected).",
+	}, []string{"action", "model", "status"})
+
+	timeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "illm_time_to_first_token_seconds",
+		Help:    "Time from a request arriving to its first response, including time queued.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"model"})
+
+	providerEvalTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "illm_provider_eval_tokens_total",
+		Help: "Tokens generated by each provider, from eval_count.",
+	}, []string{"provider"})
+
+	providerEvalSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "illm_provider_eval_seconds_total",
+		Help: "Time each provider spent generating, from eval_duration.",
+	}, []string{"provider"})
+
+	writeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "illm_websocket_write_errors_total",
+		Help: "Connections dropped because writing to them failed or their send queue filled up, by peer.",
+	}, []string{"peer", "reason"})
+)
+
+// error codes that may be used as a status label
+var knownCodes = map[string]bool{
+	internal.ErrModelUnavailable:      true,
+	internal.ErrProviderUnavailable:   true,
+	internal.ErrQueueFull:             true,
+	internal.ErrCancelled:             true,
+	internal.ErrImageTooLarge:         true,
+	internal.ErrRateLimited:           true,
+	internal.ErrInvalidRequest:        true,
+	internal.ErrModelNotFound:         true,
+	internal.ErrModelNotMultimodal:    true,
+	internal.ErrOllamaUnreachable:     true,
+	internal.ErrVideoUnavailable:      true,
+	internal.ErrTranscriptUnavailable: true,
+	internal.ErrGenerationFailed:      true,
+}
+
+// a request whose end hasn't been counted yet
+type trackedRequest struct {
+	action  string
+	model   string
+	started time.Time
+	replied bool
+}
+
+// requests being measured, by request key
+var (
+	trackedMu sync.Mutex
+	tracked   = make(map[string]*trackedRequest)
+)
+
+// start measuring a request a client sent
+func trackRequest(r *Registry, req *internal.Request) {
+	model := "other"
+	if len(r.ProvidersFor(req.Generate.Model)) > 0 {
+		model = normalizeModel(req.Generate.Model)
+	}
+	trackedMu.Lock()
+	tracked[req.Key()] = &trackedRequest{action: req.Action, model: model, started: time.Now()}
+	trackedMu.Unlock()
+}
+
+// measure a message on its way to a client. The first response of a
+// request is its first token, and a done response or an error ends it.
+func observeReply(res *internal.Request) {
+	key := res.Key()
+	trackedMu.Lock()
+	defer trackedMu.Unlock()
+	t := tracked[key]
+	if t == nil {
+		return
+	}
+
+	switch res.Action {
+	case "response":
+		if !t.replied {
+			t.replied = true
+			timeToFirstToken.WithLabelValues(t.model).Observe(time.Since(t.started).Seconds())
+		}
+		if _, done := responseStatsOf(res); done {
+			requestsTotal.WithLabelValues(t.action, t.model, "ok").Inc()
+			delete(tracked, key)
+		}
+	case "error":
+		status := "error"
+		if res.Error != nil && knownCodes[res.Error.Code] {
+			status = res.Error.Code
+		}
+		requestsTotal.WithLabelValues(t.action, t.model, status).Inc()
+		delete(tracked, key)
+	}
+}
+
+// count the requests of a client that disconnected before they ended
+func untrackClient(tag string) {
+	trackedMu.Lock()
+	defer trackedMu.Unlock()
+	for key, t := range tracked {
+		if strings.HasPrefix(key, tag+"/") {
+			requestsTotal.WithLabelValues(t.action, t.model, "disconnected").Inc()
+			delete(tracked, key)
+		}
+	}
+}
+
+// record the tokens a provider generated and how long it took
+func observeProvider(p *Provider, stats *responseStats) {
+	if stats.EvalCount <= 0 || stats.EvalDuration <= 0 {
+		return
+	}
+	identifier := p.Identifier()
+	providerEvalTokens.WithLabelValues(identifier).Add(float64(stats.EvalCount))
+	providerEvalSeconds.WithLabelValues(identifier).Add(stats.EvalDuration.Seconds())
+}
+
+// relayCollector reports the relay's state as of each scrape
+type relayCollector struct {
+	registry   *Registry
+	dispatcher *Dispatcher
+}
+
+var (
+	clientsDesc         = prometheus.NewDesc("illm_clients_connected", "Connected clients, including HTTP and SSE requests.", nil, nil)
+	providersDesc       = prometheus.NewDesc("illm_providers_connected", "Connected providers.", nil, nil)
+	queueDepthDesc      = prometheus.NewDesc("illm_queue_depth", "Requests waiting for a free provider, by model.", []string{"model"}, nil)
+	tokensPerSecondDesc = prometheus.NewDesc("illm_provider_tokens_per_second", "Smoothed generation speed of each provider, as the latency balancer sees it.", []string{"provider"}, nil)
+	outstandingDesc     = prometheus.NewDesc("illm_provider_outstanding", "Requests the relay has sent each provider that haven't ended.", []string{"provider"}, nil)
+	runningDesc         = prometheus.NewDesc("illm_provider_running", "Requests each provider reported running in its last heartbeat.", []string{"provider"}, nil)
+	waitingDesc         = prometheus.NewDesc("illm_provider_waiting", "Requests each provider reported waiting for a worker in its last heartbeat.", []string{"provider"}, nil)
+)
+
+func (c relayCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clientsDesc
+	ch <- providersDesc
+	ch <- queueDepthDesc
+	ch <- tokensPerSecondDesc
+	ch <- outstandingDesc
+	ch <- runningDesc
+	ch <- waitingDesc
+}
+
+func (c relayCollector) Collect(ch chan<- prometheus.Metric) {
+	clients, providers := c.registry.Counts()
+	ch <- prometheus.MustNewConstMetric(clientsDesc, prometheus.GaugeValue, float64(clients))
+	ch <- prometheus.MustNewConstMetric(providersDesc, prometheus.GaugeValue, float64(providers))
+	for model, depth := range c.dispatcher.QueueDepths() {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(depth), model)
+	}
+
+	// providers sharing an identifier are averaged, as one series
+	speeds := make(map[string][]float64)
+	for _, p := range c.registry.Providers() {
+		if tps := p.TokensPerSecond(); tps > 0 {
+			speeds[p.Identifier()] = append(speeds[p.Identifier()], tps)
+		}
+	}
+	for identifier, values := range speeds {
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		ch <- prometheus.MustNewConstMetric(tokensPerSecondDesc, prometheus.GaugeValue, sum/float64(len(values)), identifier)
+	}
+
+	// The relay's count and the providers' own can be compared to spot
+	// requests the relay lost track of. Loads from heartbeats that are
+	// overdue are left out rather than reported as current.
+	outstanding := make(map[string]int)
+	running := make(map[string]int)
+	waiting := make(map[string]int)
+	for _, p := range c.registry.Providers() {
+		identifier := p.Identifier()
+		outstanding[identifier] += p.Outstanding()
+		if load, at := p.Load(); time.Since(at) < heartbeatStale {
+			running[identifier] += load.Running
+			waiting[identifier] += load.Waiting
+		}
+	}
+	for identifier, n := range outstanding {
+		ch <- prometheus.MustNewConstMetric(outstandingDesc, prometheus.GaugeValue, float64(n), identifier)
+	}
+	for identifier, n := range running {
+		ch <- prometheus.MustNewConstMetric(runningDesc, prometheus.GaugeValue, float64(n), identifier)
+		ch <- prometheus.MustNewConstMetric(waitingDesc, prometheus.GaugeValue, float64(waiting[identifier]), identifier)
+	}
+}
+
+// serve the metrics on /metrics to admins
+func metricsRoutes(app *fiber.App, registry *Registry, dispatcher *Dispatcher) {
+	prometheus.MustRegister(relayCollector{registry: registry, dispatcher: dispatcher})
+	// start the write errors at zero so they can be graphed before any
+	for _, peer := range []string{"client", "provider"} {
+		writeErrors.WithLabelValues(peer, "write")
+		writeErrors.WithLabelValues(peer, "queue_full")
+	}
+	app.Get("/metrics", requireRole(roleAdmin), adaptor.HTTPHandler(promhttp.Handler()))
+}
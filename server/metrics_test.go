@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivynya/illm/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// observations recorded by a histogram series
+func observations(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := o.(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// requests counted with the status, for generations of llama3
+func requestsWith(status string) float64 {
+	return testutil.ToFloat64(requestsTotal.WithLabelValues("generate", normalizeModel("llama3"), status))
+}
+
+func TestRequestMetrics(t *testing.T) {
+	failed := &internal.Error{Code: internal.ErrOllamaUnreachable, Message: "down"}
+	unknown := &internal.Error{Code: "something_new", Message: "?"}
+	tests := []struct {
+		name   string
+		end    func(r *Relay, p *Provider, c *Conn, req *internal.Request)
+		status string
+		ttft   uint64 // first tokens observed
+	}{
+		{"finished", func(r *Relay, p *Provider, c *Conn, req *internal.Request) {
+			r.fromProvider(p, testResponse(req, false, 0))
+			r.fromProvider(p, testResponse(req, true, 5))
+		}, "ok", 1},
+		{"failed", func(r *Relay, p *Provider, c *Conn, req *internal.Request) {
+			r.fromProvider(p, &internal.Request{Tag: req.Tag, ID: req.ID, Action: "error", Error: failed})
+		}, internal.ErrOllamaUnreachable, 0},
+		{"failed with an unknown code", func(r *Relay, p *Provider, c *Conn, req *internal.Request) {
+			r.fromProvider(p, &internal.Request{Tag: req.Tag, ID: req.ID, Action: "error", Error: unknown})
+		}, "error", 0},
+		{"client disconnected", func(r *Relay, p *Provider, c *Conn, req *internal.Request) {
+			r.fromProvider(p, testResponse(req, false, 0))
+			r.clientLeft(c)
+		}, "disconnected", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRelay(Limits{})
+			client, _ := addTestClient(t, r, "alice")
+			provider, providerWS := addTestProvider(t, r, "box", 1, "llama3")
+			before := requestsWith(tt.status)
+			ttftBefore := observations(t, timeToFirstToken.WithLabelValues(normalizeModel("llama3")))
+
+			r.fromClient(testGenerate(client, "1", "llama3"))
+			tt.end(r, provider, client, providerWS.waitFor(t, "generate", 1)[0])
+
+			if got := requestsWith(tt.status) - before; got != 1 {
+				t.Errorf("illm_requests_total{status=%q} rose by %v, want 1", tt.status, got)
+			}
+			ttft := observations(t, timeToFirstToken.WithLabelValues(normalizeModel("llama3"))) - ttftBefore
+			if ttft != tt.ttft {
+				t.Errorf("illm_time_to_first_token_seconds observed %d times, want %d", ttft, tt.ttft)
+			}
+		})
+	}
+}
+
+// Requests sent without an ID are measured separately even when they
+// overlap
+func TestOverlappingAnonymousRequestsAreEachCounted(t *testing.T) {
+	r := newTestRelay(Limits{})
+	client, _ := addTestClient(t, r, "alice")
+	provider, providerWS := addTestProvider(t, r, "box", 2, "llama3")
+	before := requestsWith("ok")
+	ttftBefore := observations(t, timeToFirstToken.WithLabelValues(normalizeModel("llama3")))
+
+	r.fromClient(testGenerate(client, "", "llama3"))
+	r.fromClient(testGenerate(client, "", "llama3"))
+	sent := providerWS.waitFor(t, "generate", 2)
+	for _, req := range sent {
+		r.fromProvider(provider, testResponse(req, false, 0))
+	}
+	for _, req := range sent {
+		r.fromProvider(provider, testResponse(req, true, 5))
+	}
+
+	if got := requestsWith("ok") - before; got != 2 {
+		t.Errorf("illm_requests_total{status=\"ok\"} rose by %v, want 2", got)
+	}
+	if got := observations(t, timeToFirstToken.WithLabelValues(normalizeModel("llama3"))) - ttftBefore; got != 2 {
+		t.Errorf("illm_time_to_first_token_seconds observed %d times, want 2", got)
+	}
+}
+
+func TestWriteErrorMetrics(t *testing.T) {
+	t.Run("write", func(t *testing.T) {
+		before := testutil.ToFloat64(writeErrors.WithLabelValues("client", "write"))
+		ws := &fakeSocket{fail: true}
+		c := newConn("dead", "client", ws)
+		c.Send([]byte(`{}`))
+		eventually(t, ws.isClosed, "the dead connection to be closed")
+		if got := testutil.ToFloat64(writeErrors.WithLabelValues("client", "write")) - before; got != 1 {
+			t.Errorf("illm_websocket_write_errors_total{reason=\"write\"} rose by %v, want 1", got)
+		}
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		before := testutil.ToFloat64(writeErrors.WithLabelValues("provider", "queue_full"))
+		writesBefore := testutil.ToFloat64(writeErrors.WithLabelValues("provider", "write"))
+		// nothing reads what is written, so the writer blocks
+		ws := newChanSocket()
+		c := newConn("stuck", "provider", ws)
+		var err error
+		for i := 0; i <= sendQueueSize+1 && err == nil; i++ {
+			err = c.Send([]byte(`{}`))
+		}
+		if err != errSendQueueFull {
+			t.Fatalf("got %v, want errSendQueueFull", err)
+		}
+		if got := testutil.ToFloat64(writeErrors.WithLabelValues("provider", "queue_full")) - before; got != 1 {
+			t.Errorf("illm_websocket_write_errors_total{reason=\"queue_full\"} rose by %v, want 1", got)
+		}
+		// the write it was stuck on fails as it closes, and isn't counted again
+		<-c.stopped
+		if got := testutil.ToFloat64(writeErrors.WithLabelValues("provider", "write")) - writesBefore; got != 0 {
+			t.Errorf("illm_websocket_write_errors_total{reason=\"write\"} rose by %v, want 0", got)
+		}
+	})
+}
+
+// Providers' own view of their load is reported next to the relay's, and
+// only from heartbeats that aren't overdue
+func TestProviderLoadMetrics(t *testing.T) {
+	r := newTestRelay(Limits{})
+	client, _ := addTestClient(t, r, "alice")
+	box, boxWS := addTestProvider(t, r, "box", 1, "llama3")
+	quiet, _ := addTestProvider(t, r, "quiet", 1, "mistral")
+	r.fromProvider(box, &internal.Request{Action: "heartbeat", Heartbeat: &internal.Heartbeat{Running: 2, Waiting: 1, Concurrency: 1}})
+	r.fromProvider(quiet, &internal.Request{Action: "heartbeat", Heartbeat: &internal.Heartbeat{Running: 5}})
+	quiet.mu.Lock()
+	quiet.lastBeat = time.Now().Add(-heartbeatStale)
+	quiet.mu.Unlock()
+
+	r.fromClient(testGenerate(client, "1", "llama3"))
+	boxWS.waitFor(t, "generate", 1)
+
+	collector := relayCollector{registry: r.registry, dispatcher: r.dispatcher}
+	want := `
+# HELP illm_provider_outstanding Requests the relay has sent each provider that haven't ended.
+# TYPE illm_provider_outstanding gauge
+illm_provider_outstanding{provider="box"} 1
+illm_provider_outstanding{provider="quiet"} 0
+# HELP illm_provider_running Requests each provider reported running in its last heartbeat.
+# TYPE illm_provider_running gauge
+illm_provider_running{provider="box"} 2
+# HELP illm_provider_waiting Requests each provider reported waiting for a worker in its last heartbeat.
+# TYPE illm_provider_waiting gauge
+illm_provider_waiting{provider="box"} 1
+`
+	err := testutil.CollectAndCompare(collector, strings.NewReader(want), "illm_provider_outstanding", "illm_provider_running", "illm_provider_waiting")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
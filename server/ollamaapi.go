@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ivynya/illm/internal"
+	"github.com/ivynya/illm/ollama"
+	"github.com/valyala/fasthttp"
+)
+
+// Endpoints mirroring ollama's own REST API, so anything that talks to
+// ollama can be pointed at the relay instead. Provider responses are
+// already ollama chunks, so streams pass them through as NDJSON. Bodies
+// are read as JSON whatever their content type, as ollama does.
+func (r *Relay) ollamaRoutes(app fiber.Router) {
+	api := app.Group("/api")
+	api.Get("/tags", r.ollamaTags)
+	api.Post("/generate", r.ollamaGenerate)
+	api.Post("/chat", r.ollamaChat)
+	api.Post("/embeddings", r.ollamaEmbeddings)
+}
+
+// ollama's options use the same names as ours except for num_predict
+type ollamaOptions struct {
+	internal.GenerateOptions
+	NumPredict int `json:"num_predict"`
+}
+
+func (o *ollamaOptions) generateOptions() *internal.GenerateOptions {
+	opts := o.GenerateOptions
+	if o.NumPredict > 0 {
+		opts.MaxTokens = o.NumPredict
+	}
+	return &opts
+}
+
+type ollamaGenerateRequest struct {
+	Model   string        `json:"model"`
+	Prompt  string        `json:"prompt"`
+	System  string        `json:"system"`
+	Context []int         `json:"context"`
+	Images  []string      `json:"images"`
+	Stream  *bool         `json:"stream"`
+	Options ollamaOptions `json:"options"`
+}
+
+type ollamaChatRequest struct {
+	Model    string             `json:"model"`
+	Messages []internal.Message `json:"messages"`
+	Stream   *bool              `json:"stream"`
+	Options  ollamaOptions      `json:"options"`
+}
+
+func ollamaError(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).JSON(fiber.Map{"error": message})
+}
+
+// reply with the error a relayed request failed with
+func ollamaRelayError(c *fiber.Ctx, err error) error {
+	var relayErr *relayError
+	if errors.As(err, &relayErr) {
+		setRetryAfter(c, relayErr)
+		return ollamaError(c, httpStatus(relayErr.Code), relayErr.Message)
+	}
+	return ollamaError(c, fiber.StatusBadGateway, err.Error())
+}
+
+func (r *Relay) ollamaTags(c *fiber.Ctx) error {
+	list := ollama.ListResponse{Models: []ollama.ModelResponse{}}
+	for _, name := range r.registry.Models() {
+		list.Models = append(list.Models, ollama.ModelResponse{Name: name, Model: name})
+	}
+	return c.JSON(list)
+}
+
+func (r *Relay) ollamaGenerate(c *fiber.Ctx) error {
+	body := &ollamaGenerateRequest{}
+	if err := json.Unmarshal(c.Body(), body); err != nil {
+		return ollamaError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	req := &internal.Request{Action: "generate"}
+	req.Generate.Model = body.Model
+	req.Generate.Prompt = body.Prompt
+	req.Generate.System = body.System
+	req.Generate.Context = body.Context
+	req.Generate.Images = body.Images
+	req.Generate.Options = body.Options.generateOptions()
+	return r.ollamaRelay(c, req, body.Stream == nil || *body.Stream)
+}
+
+func (r *Relay) ollamaChat(c *fiber.Ctx) error {
+	body := &ollamaChatRequest{}
+	if err := json.Unmarshal(c.Body(), body); err != nil {
+		return ollamaError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	req := &internal.Request{Action: "chat"}
+	req.Generate.Model = body.Model
+	req.Generate.Messages = body.Messages
+	req.Generate.Options = body.Options.generateOptions()
+	return r.ollamaRelay(c, req, body.Stream == nil || *body.Stream)
+}
+
+// relay a generate or chat request and pass the provider's chunks through
+// as NDJSON, or merge them into one response when not streaming
+func (r *Relay) ollamaRelay(c *fiber.Ctx, req *internal.Request, stream bool) error {
+	s, err := r.openSession(identityOf(c.Locals("identity")).User)
+	if err != nil {
+		return ollamaError(c, fiber.StatusInternalServerError, err.Error())
+	}
+	defer s.watch(c)()
+	s.send(req)
+
+	// wait for the first response so failures get a proper status code
+	first, err := s.next()
+	if err != nil {
+		s.close()
+		return ollamaRelayError(c, err)
+	}
+
+	if !stream {
+		defer s.close()
+		text := ""
+		for data := first; ; {
+			chunk := &ollamaChunk{}
+			if err := json.Unmarshal([]byte(data), chunk); err != nil {
+				return ollamaError(c, fiber.StatusBadGateway, err.Error())
+			}
+			text += chunk.text()
+			if chunk.Done {
+				// the last chunk carries the stats and context, keep them
+				// as they are and swap in the whole text
+				res := map[string]json.RawMessage{}
+				if err := json.Unmarshal([]byte(data), &res); err != nil {
+					return ollamaError(c, fiber.StatusBadGateway, err.Error())
+				}
+				field, value := "response", any(text)
+				if req.Action == "chat" {
+					field, value = "message", internal.Message{Role: "assistant", Content: text}
+				}
+				res[field], _ = json.Marshal(value)
+				return c.JSON(res)
+			}
+			if data, err = s.next(); err != nil {
+				return ollamaRelayError(c, err)
+			}
+		}
+	}
+
+	c.Set("Content-Type", "application/x-ndjson")
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer s.close()
+		for data := first; ; {
+			if writeLine(w, []byte(data)) != nil {
+				return
+			}
+			if stats, ok := parseResponseStats(data); ok && stats.Done {
+				return
+			}
+
+			var err error
+			if data, err = s.next(); err != nil {
+				// ollama's client reads an error line as a failed stream
+				line, _ := json.Marshal(fiber.Map{"error": err.Error()})
+				writeLine(w, line)
+				return
+			}
+		}
+	}))
+	return nil
+}
+
+// write one line of NDJSON and flush it, failing once the client is gone
+func writeLine(w *bufio.Writer, line []byte) error {
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (r *Relay) ollamaEmbeddings(c *fiber.Ctx) error {
+	body := &ollama.EmbeddingRequest{}
+	if err := json.Unmarshal(c.Body(), body); err != nil {
+		return ollamaError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	req := &internal.Request{Action: "embed"}
+	req.Generate.Model = body.Model
+	req.Generate.Input = []string{body.Prompt}
+
+	s, err := r.openSession(identityOf(c.Locals("identity")).User)
+	if err != nil {
+		return ollamaError(c, fiber.StatusInternalServerError, err.Error())
+	}
+	defer s.close()
+	defer s.watch(c)()
+	s.send(req)
+
+	res := ollama.EmbeddingResponse{}
+	for {
+		frame, err := s.next()
+		if err != nil {
+			return ollamaRelayError(c, err)
+		}
+		chunk := &internal.EmbedResponse{}
+		if err := json.Unmarshal([]byte(frame), chunk); err != nil {
+			return ollamaError(c, fiber.StatusBadGateway, err.Error())
+		}
+		if len(chunk.Embeddings) > 0 {
+			res.Embedding = chunk.Embeddings[0]
+		}
+		if chunk.Done {
+			return c.JSON(res)
+		}
+	}
+}
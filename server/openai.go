@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ivynya/illm/internal"
+	"github.com/valyala/fasthttp"
+)
+
+// OpenAI-compatible endpoints, so existing SDKs and tools can use the
+// relay's providers. Requests become internal.Request messages routed like
+// any other, and the ollama chunks that come back are reshaped into
+// OpenAI responses.
+func (r *Relay) openAIRoutes(app fiber.Router) {
+	v1 := app.Group("/v1")
+	v1.Get("/models", r.openAIModels)
+	v1.Post("/chat/completions", r.openAIChatCompletions)
+	v1.Post("/completions", r.openAICompletions)
+	v1.Post("/embeddings", r.openAIEmbeddings)
+}
+
+// stringList is a JSON string or list of strings, as OpenAI accepts for
+// stop, prompt and input
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(l))
+}
+
+// openAIContent is a message's content, either a string or a list of text
+// and image_url parts
+type openAIContent struct {
+	Text   string
+	Images []string
+}
+
+func (c *openAIContent) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &c.Text); err == nil {
+		return nil
+	}
+	var parts []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		ImageURL struct {
+			URL string `json:"url"`
+		} `json:"image_url"`
+	}
+	if err := json.Unmarshal(b, &parts); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			c.Text += part.Text
+		case "image_url":
+			c.Images = append(c.Images, part.ImageURL.URL)
+		}
+	}
+	return nil
+}
+
+type openAIMessage struct {
+	Role    string        `json:"role"`
+	Content openAIContent `json:"content"`
+}
+
+// sampling options shared by completions and chat completions
+type openAIOptions struct {
+	Temperature      *float64   `json:"temperature"`
+	TopP             float64    `json:"top_p"`
+	MaxTokens        int        `json:"max_tokens"`
+	Stop             stringList `json:"stop"`
+	Seed             *int       `json:"seed"`
+	PresencePenalty  float64    `json:"presence_penalty"`
+	FrequencyPenalty float64    `json:"frequency_penalty"`
+}
+
+func (o openAIOptions) generateOptions() *internal.GenerateOptions {
+	return &internal.GenerateOptions{
+		Temperature:      o.Temperature,
+		TopP:             o.TopP,
+		MaxTokens:        o.MaxTokens,
+		Stop:             o.Stop,
+		Seed:             o.Seed,
+		PresencePenalty:  o.PresencePenalty,
+		FrequencyPenalty: o.FrequencyPenalty,
+	}
+}
+
+type openAIChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []openAIMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	openAIOptions
+}
+
+type openAICompletionRequest struct {
+	Model  string     `json:"model"`
+	Prompt stringList `json:"prompt"`
+	Stream bool       `json:"stream"`
+	openAIOptions
+}
+
+type openAIEmbeddingRequest struct {
+	Model string     `json:"model"`
+	Input stringList `json:"input"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type openAIChoice struct {
+	Index        int          `json:"index"`
+	Message      *openAIReply `json:"message,omitempty"`
+	Delta        *openAIReply `json:"delta,omitempty"`
+	Text         *string      `json:"text,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type openAIReply struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content"`
+}
+
+type openAIResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *openAIUsage   `json:"usage,omitempty"`
+}
+
+// an ollama generate or chat response, whichever the provider streamed
+type ollamaChunk struct {
+	Response string `json:"response"`
+	Message  *struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Done            bool `json:"done"`
+	PromptEvalCount int  `json:"prompt_eval_count"`
+	EvalCount       int  `json:"eval_count"`
+}
+
+func (c *ollamaChunk) text() string {
+	if c.Message != nil {
+		return c.Message.Content
+	}
+	return c.Response
+}
+
+func openAIError(c *fiber.Ctx, status int, code string, message string) error {
+	kind := "server_error"
+	if status < fiber.StatusInternalServerError {
+		kind = "invalid_request_error"
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"error": fiber.Map{
+			"message": message,
+			"type":    kind,
+			"code":    code,
+		},
+	})
+}
+
+// reply with the error a relayed request failed with
+func openAIRelayError(c *fiber.Ctx, err error) error {
+	var relayErr *relayError
+	if errors.As(err, &relayErr) {
+		setRetryAfter(c, relayErr)
+		return openAIError(c, httpStatus(relayErr.Code), relayErr.Code, relayErr.Message)
+	}
+	return openAIError(c, fiber.StatusBadGateway, internal.ErrProviderUnavailable, err.Error())
+}
+
+func (r *Relay) openAIModels(c *fiber.Ctx) error {
+	type model struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		OwnedBy string `json:"owned_by"`
+	}
+	models := []model{}
+	for _, name := range r.registry.Models() {
+		models = append(models, model{ID: name, Object: "model", OwnedBy: "illm"})
+	}
+	return c.JSON(fiber.Map{"object": "list", "data": models})
+}
+
+func (r *Relay) openAIChatCompletions(c *fiber.Ctx) error {
+	body := &openAIChatRequest{}
+	if err := c.BodyParser(body); err != nil {
+		return openAIError(c, fiber.StatusBadRequest, internal.ErrInvalidRequest, err.Error())
+	}
+
+	req := &internal.Request{Action: "chat"}
+	req.Generate.Model = body.Model
+	req.Generate.Options = body.generateOptions()
+	for _, message := range body.Messages {
+		req.Generate.Messages = append(req.Generate.Messages, internal.Message{
+			Role:    message.Role,
+			Content: message.Content.Text,
+			Images:  message.Content.Images,
+		})
+	}
+	return r.openAIGenerate(c, req, body.Model, body.Stream)
+}
+
+func (r *Relay) openAICompletions(c *fiber.Ctx) error {
+	body := &openAICompletionRequest{}
+	if err := c.BodyParser(body); err != nil {
+		return openAIError(c, fiber.StatusBadRequest, internal.ErrInvalidRequest, err.Error())
+	}
+	if len(body.Prompt) != 1 {
+		return openAIError(c, fiber.StatusBadRequest, internal.ErrInvalidRequest, "Exactly one prompt is supported")
+	}
+
+	req := &internal.Request{Action: "generate"}
+	req.Generate.Model = body.Model
+	req.Generate.Prompt = body.Prompt[0]
+	req.Generate.Options = body.generateOptions()
+	return r.openAIGenerate(c, req, body.Model, body.Stream)
+}
+
+// relay a chat or generate request and answer with a completion, or a
+// stream of completion chunks as server-sent events
+func (r *Relay) openAIGenerate(c *fiber.Ctx, req *internal.Request, model string, stream bool) error {
+	s, err := r.openSession(identityOf(c.Locals("identity")).User)
+	if err != nil {
+		return openAIError(c, fiber.StatusInternalServerError, "", err.Error())
+	}
+	defer s.watch(c)()
+	s.send(req)
+
+	res := &openAIResponse{
+		ID:      "chatcmpl-" + s.id,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+	}
+	if req.Action == "generate" {
+		res.ID, res.Object = "cmpl-"+s.id, "text_completion"
+	}
+
+	// wait for the first response so failures get a proper status code
+	first, err := s.next()
+	if err != nil {
+		s.close()
+		return openAIRelayError(c, err)
+	}
+
+	if !stream {
+		defer s.close()
+		text, usage := "", &openAIUsage{}
+		for data := first; ; {
+			chunk := &ollamaChunk{}
+			if err := json.Unmarshal([]byte(data), chunk); err != nil {
+				return openAIError(c, fiber.StatusBadGateway, internal.ErrGenerationFailed, err.Error())
+			}
+			text += chunk.text()
+			if chunk.Done {
+				usage.PromptTokens, usage.CompletionTokens = chunk.PromptEvalCount, chunk.EvalCount
+				usage.TotalTokens = chunk.PromptEvalCount + chunk.EvalCount
+				break
+			}
+			if data, err = s.next(); err != nil {
+				return openAIRelayError(c, err)
+			}
+		}
+		res.Choices = []openAIChoice{openAIDone(req.Action, text, false)}
+		res.Usage = usage
+		return c.JSON(res)
+	}
+
+	if res.Object == "chat.completion" {
+		res.Object = "chat.completion.chunk"
+	}
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer s.close()
+		for data := first; ; {
+			var event any
+			chunk := &ollamaChunk{}
+			err := json.Unmarshal([]byte(data), chunk)
+			switch {
+			case err != nil:
+				event = openAIErrorEvent(err)
+			case chunk.Done:
+				res.Choices = []openAIChoice{openAIDone(req.Action, chunk.text(), true)}
+				event = res
+			default:
+				res.Choices = []openAIChoice{openAIDelta(req.Action, chunk.text())}
+				event = res
+			}
+			if writeEvent(w, event) != nil || err != nil {
+				return
+			}
+			if chunk.Done {
+				fmt.Fprint(w, "data: [DONE]\n\n")
+				w.Flush()
+				return
+			}
+
+			if data, err = s.next(); err != nil {
+				writeEvent(w, openAIErrorEvent(err))
+				return
+			}
+		}
+	}))
+	return nil
+}
+
+// a streamed piece of a completion
+func openAIDelta(action string, text string) openAIChoice {
+	if action == "generate" {
+		return openAIChoice{Text: &text}
+	}
+	return openAIChoice{Delta: &openAIReply{Role: "assistant", Content: text}}
+}
+
+// the final choice of a completion, which is the last delta when streaming
+func openAIDone(action string, text string, stream bool) openAIChoice {
+	stop := "stop"
+	choice := openAIDelta(action, text)
+	choice.FinishReason = &stop
+	if action != "generate" && !stream {
+		choice.Message, choice.Delta = choice.Delta, nil
+	}
+	return choice
+}
+
+func openAIErrorEvent(err error) fiber.Map {
+	code, message := internal.ErrGenerationFailed, err.Error()
+	var relayErr *relayError
+	if errors.As(err, &relayErr) {
+		code = relayErr.Code
+	}
+	return fiber.Map{"error": fiber.Map{"message": message, "type": "server_error", "code": code}}
+}
+
+// write a server-sent event and flush it, failing once the client is gone
+func writeEvent(w *bufio.Writer, event any) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (r *Relay) openAIEmbeddings(c *fiber.Ctx) error {
+	body := &openAIEmbeddingRequest{}
+	if err := c.BodyParser(body); err != nil {
+		return openAIError(c, fiber.StatusBadRequest, internal.ErrInvalidRequest, err.Error())
+	}
+
+	req := &internal.Request{Action: "embed"}
+	req.Generate.Model = body.Model
+	req.Generate.Input = body.Input
+
+	s, err := r.openSession(identityOf(c.Locals("identity")).User)
+	if err != nil {
+		return openAIError(c, fiber.StatusInternalServerError, "", err.Error())
+	}
+	defer s.close()
+	defer s.watch(c)()
+	s.send(req)
+
+	type embedding struct {
+		Object    string    `json:"object"`
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	}
+	data := []embedding{}
+	for {
+		frame, err := s.next()
+		if err != nil {
+			return openAIRelayError(c, err)
+		}
+		chunk := &internal.EmbedResponse{}
+		if err := json.Unmarshal([]byte(frame), chunk); err != nil {
+			return openAIError(c, fiber.StatusBadGateway, internal.ErrGenerationFailed, err.Error())
+		}
+		for i, vector := range chunk.Embeddings {
+			data = append(data, embedding{Object: "embedding", Index: chunk.Index + i, Embedding: vector})
+		}
+		if chunk.Done {
+			break
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"object": "list",
+		"data":   data,
+		"model":  body.Model,
+		"usage":  fiber.Map{"prompt_tokens": 0, "total_tokens": 0},
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ivynya/illm/internal"
+)
+
+// weight of the measurements from each newly finished request in the
+// smoothed tokens/sec and duration
+const tokenRateSmoothing = 0.3
+
+// Provider is a connected provider and what it has advertised about itself
+type Provider struct {
+	*Conn
+
+	outstanding atomic.Int64
+	current     int // weighted round-robin state, guarded by weightedBalancer
+
+	mu           sync.RWMutex
+	identifier   string
+	models       []string
+	embedModels  map[string]bool
+	weight       int
+	concurrency  int
+	tokensPerSec float64
+	duration     time.Duration
+	load         internal.Heartbeat // as of the last heartbeat
+	lastBeat     time.Time
+	publicKey    string // for end-to-end encryption, if it advertised a valid one
+	fingerprint  string
+}
+
+func (p *Provider) Identifier() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.identifier
+}
+
+// Key returns the provider's public key for end-to-end encryption, or
+// false if it has none
+func (p *Provider) Key() (internal.ProviderKey, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return internal.ProviderKey{
+		Identifier:  p.identifier,
+		PublicKey:   p.publicKey,
+		Fingerprint: p.fingerprint,
+	}, p.fingerprint != ""
+}
+
+// Fingerprint returns the fingerprint of the provider's public key, or ""
+func (p *Provider) Fingerprint() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.fingerprint
+}
+
+// Models returns the models the provider advertised at handshake
+func (p *Provider) Models() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.models
+}
+
+// CanEmbed reports whether model is one of the provider's embedding models
+func (p *Provider) CanEmbed(model string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.embedModels[normalizeModel(model)]
+}
+
+// Weight returns the provider's weighted round-robin weight, at least 1
+func (p *Provider) Weight() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return max(p.weight, 1)
+}
+
+// Concurrency returns how many requests the provider will run at once
+func (p *Provider) Concurrency() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return max(p.concurrency, 1)
+}
+
+// Outstanding returns how many requests the provider is running
+func (p *Provider) Outstanding() int {
+	return int(p.outstanding.Load())
+}
+
+// TokensPerSecond returns the smoothed generation speed of the provider,
+// or 0 if it has not finished a request yet
+func (p *Provider) TokensPerSecond() float64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.tokensPerSec
+}
+
+// AverageDuration returns the smoothed time the provider takes to finish
+// a request, or 0 if it has not finished one yet
+func (p *Provider) AverageDuration() time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.duration
+}
+
+// Load returns the load the provider last reported and when, or a zero
+// time if it has never sent a heartbeat
+func (p *Provider) Load() (internal.Heartbeat, time.Time) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.load, p.lastBeat
+}
+
+// record the load a provider reported
+func (p *Provider) heartbeat(hb *internal.Heartbeat) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.load = *hb
+	p.lastBeat = time.Now()
+}
+
+// the request was sent to the provider
+func (p *Provider) started() {
+	p.outstanding.Add(1)
+}
+
+// the provider finished a request or failed it
+func (p *Provider) finished() {
+	if p.outstanding.Add(-1) < 0 {
+		p.outstanding.Store(0)
+	}
+}
+
+// record the speed and duration of a finished generation
+func (p *Provider) observe(stats *responseStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if stats.EvalCount > 0 && stats.EvalDuration > 0 {
+		tps := float64(stats.EvalCount) / stats.EvalDuration.Seconds()
+		p.tokensPerSec = smooth(p.tokensPerSec, tps)
+	}
+	if stats.TotalDuration > 0 {
+		p.duration = time.Duration(smooth(float64(p.duration), float64(stats.TotalDuration)))
+	}
+}
+
+// exponentially weighted moving average, seeded by the first sample
+func smooth(avg float64, sample float64) float64 {
+	if avg == 0 {
+		return sample
+	}
+	return avg + tokenRateSmoothing*(sample-avg)
+}
+
+// generation stats carried by the final response frame of a request
+type responseStats struct {
+	Done            bool          `json:"done"`
+	TotalDuration   time.Duration `json:"total_duration"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	EvalDuration    time.Duration `json:"eval_duration"`
+}
+
+// the stats of a response if it is the final frame, read from its data or
+// for a sealed response from the readable part of the seal
+func responseStatsOf(res *internal.Request) (*responseStats, bool) {
+	if res.Sealed == nil {
+		return parseResponseStats(res.Data)
+	}
+	if !res.Sealed.Done || res.Sealed.PromptEvalCount < 0 || res.Sealed.EvalCount < 0 {
+		return nil, false
+	}
+	return &responseStats{
+		Done:            true,
+		TotalDuration:   time.Duration(res.Sealed.TotalDuration),
+		PromptEvalCount: res.Sealed.PromptEvalCount,
+		EvalCount:       res.Sealed.EvalCount,
+		EvalDuration:    time.Duration(res.Sealed.EvalDuration),
+	}, true
+}
+
+// parse the stats out of a response frame's data if it is the final frame.
+// Negative counts would refund users, so a frame with them has no stats.
+func parseResponseStats(data string) (*responseStats, bool) {
+	if !strings.Contains(data, `"done":true`) {
+		return nil, false
+	}
+	stats := &responseStats{}
+	if err := json.Unmarshal([]byte(data), stats); err != nil || !stats.Done {
+		return nil, false
+	}
+	if stats.PromptEvalCount < 0 || stats.EvalCount < 0 {
+		return nil, false
+	}
+	return stats, true
+}
+
+// normalize a model name the way ollama does, so "llama2" and
+// "llama2:latest" are the same model
+func normalizeModel(model string) string {
+	if model != "" && !strings.Contains(model, ":") {
+		return model + ":latest"
+	}
+	return model
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/ivynya/illm/internal"
+	"github.com/ivynya/illm/internal/e2e"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+)
+
+// number of outbound messages a connection may have waiting before it is
+// considered too slow and dropped
+const sendQueueSize = 256
+
+var (
+	errConnClosed    = errors.New("connection closed")
+	errSendQueueFull = errors.New("send queue full")
+)
+
+// socket is the part of a websocket connection the registry writes to
+type socket interface {
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+// Conn is a registered connection with its own outbound queue. Only the
+// connection's writer goroutine ever writes to the underlying socket.
+type Conn struct {
+	Tag  string
+	User string // who the connection authenticated as
+	peer string // client or provider
+
+	ws      socket
+	send    chan []byte
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+	closing sync.Mutex // orders Close against pushing back the read deadline
+}
+
+func newConn(tag string, peer string, ws socket) *Conn {
+	c := &Conn{
+		Tag:     tag,
+		peer:    peer,
+		ws:      ws,
+		send:    make(chan []byte, sendQueueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+func (c *Conn) writeLoop() {
+	defer close(c.stopped)
+
+	// only real websockets are pinged
+	deadlines, live := c.ws.(deadliner)
+	var ping <-chan time.Time
+	if live {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		messageType, data := websocket.TextMessage, []byte(nil)
+		select {
+		case data = <-c.send:
+			// queued by Shutdown
+			if data == nil {
+				c.Close()
+				return
+			}
+		case <-ping:
+			messageType = websocket.PingMessage
+		case <-c.done:
+			return
+		}
+
+		if live {
+			deadlines.SetWriteDeadline(time.Now().Add(writeWait))
+		}
+		err := c.ws.WriteMessage(messageType, data)
+		if err != nil {
+			// a write cut short by Close isn't a write error of its own
+			select {
+			case <-c.done:
+			default:
+				log.Println("Websocket write error:", err)
+				writeErrors.WithLabelValues(c.peer, "write").Inc()
+			}
+			c.Close()
+			return
+		}
+	}
+}
+
+// Send queues data for the writer goroutine. A connection whose queue is
+// full is closed rather than allowed to block everyone else.
+func (c *Conn) Send(data []byte) error {
+	select {
+	case <-c.done:
+		return errConnClosed
+	default:
+	}
+
+	select {
+	case c.send <- data:
+		return nil
+	case <-c.done:
+		return errConnClosed
+	default:
+		log.Println("Send queue full, dropping connection", c.Tag)
+		writeErrors.WithLabelValues(c.peer, "queue_full").Inc()
+		c.Close()
+		return errSendQueueFull
+	}
+}
+
+// Close stops the writer and closes the socket, which also ends the read
+// loop of the handler that owns the connection. Safe to call repeatedly.
+func (c *Conn) Close() {
+	c.once.Do(func() {
+		c.closing.Lock()
+		defer c.closing.Unlock()
+		close(c.done)
+		c.ws.Close()
+		// fasthttp only really closes a websocket once its handler
+		// returns, so fail the handler's read to make it return
+		if d, ok := c.ws.(deadliner); ok {
+			d.SetReadDeadline(time.Now())
+		}
+	})
+}
+
+// Shutdown closes the connection once everything already queued on it has
+// been written
+func (c *Conn) Shutdown() {
+	c.Send(nil)
+}
+
+// Close the connection, then wait for its writer so the socket is never
+// written to after the handler that owns it has returned
+func (c *Conn) closeAndWait() {
+	c.Close()
+	<-c.stopped
+}
+
+// Registry owns every connected client and provider, and an index of
+// which providers can serve each model
+type Registry struct {
+	mu        sync.RWMutex
+	clients   map[string]*Conn
+	providers map[string]*Provider
+	models    map[string]map[string]*Provider
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		clients:   make(map[string]*Conn),
+		providers: make(map[string]*Provider),
+		models:    make(map[string]map[string]*Provider),
+	}
+}
+
+func (r *Registry) AddClient(ws socket, user string) (*Conn, error) {
+	tag, err := gonanoid.New()
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(tag, "client", ws)
+	c.User = user
+
+	r.mu.Lock()
+	r.clients[tag] = c
+	r.mu.Unlock()
+	return c, nil
+}
+
+func (r *Registry) AddProvider(ws socket, user string) (*Provider, error) {
+	tag, err := gonanoid.New()
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{Conn: newConn(tag, "provider", ws)}
+	p.User = user
+
+	r.mu.Lock()
+	r.providers[tag] = p
+	r.mu.Unlock()
+	return p, nil
+}
+
+func (r *Registry) RemoveClient(tag string) {
+	r.mu.Lock()
+	c := r.clients[tag]
+	delete(r.clients, tag)
+	r.mu.Unlock()
+
+	if c != nil {
+		c.closeAndWait()
+	}
+}
+
+func (r *Registry) RemoveProvider(tag string) {
+	r.mu.Lock()
+	p := r.providers[tag]
+	delete(r.providers, tag)
+	if p != nil {
+		r.unindex(p)
+	}
+	r.mu.Unlock()
+
+	if p != nil {
+		p.closeAndWait()
+	}
+}
+
+// Identify records what a provider advertised at handshake and indexes it
+// under each of its models
+func (r *Registry) Identify(p *Provider, hs *internal.Handshake) {
+	normalized := make([]string, 0, len(hs.Models))
+	for _, model := range hs.Models {
+		normalized = append(normalized, normalizeModel(model))
+	}
+	fingerprint := ""
+	if key, err := e2e.ParsePublicKey(hs.PublicKey); err == nil {
+		fingerprint = e2e.Fingerprint(key)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.providers[p.Tag] != p {
+		return
+	}
+	r.unindex(p)
+
+	p.mu.Lock()
+	p.identifier = hs.Identifier
+	p.models = normalized
+	p.embedModels = make(map[string]bool)
+	for _, model := range hs.EmbedModels {
+		p.embedModels[normalizeModel(model)] = true
+	}
+	p.weight = hs.Weight
+	p.concurrency = hs.Concurrency
+	p.publicKey = hs.PublicKey
+	p.fingerprint = fingerprint
+	if fingerprint == "" {
+		p.publicKey = ""
+	}
+	p.mu.Unlock()
+
+	for _, model := range normalized {
+		if r.models[model] == nil {
+			r.models[model] = make(map[string]*Provider)
+		}
+		r.models[model][p.Tag] = p
+	}
+}
+
+// remove a provider from the model index, r.mu must be held
+func (r *Registry) unindex(p *Provider) {
+	for _, model := range p.Models() {
+		delete(r.models[model], p.Tag)
+		if len(r.models[model]) == 0 {
+			delete(r.models, model)
+		}
+	}
+}
+
+// ProvidersFor returns a snapshot of the providers that have model installed
+func (r *Registry) ProvidersFor(model string) []*Provider {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	index := r.models[normalizeModel(model)]
+	providers := make([]*Provider, 0, len(index))
+	for _, p := range index {
+		providers = append(providers, p)
+	}
+	return providers
+}
+
+// Models returns every model at least one provider has installed
+func (r *Registry) Models() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	models := make([]string, 0, len(r.models))
+	for model := range r.models {
+		models = append(models, model)
+	}
+	slices.Sort(models)
+	return models
+}
+
+// Client returns the client with the given tag, or nil
+func (r *Registry) Client(tag string) *Conn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.clients[tag]
+}
+
+// Clients returns a snapshot of all connected clients
+func (r *Registry) Clients() []*Conn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	conns := make([]*Conn, 0, len(r.clients))
+	for _, c := range r.clients {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Providers returns a snapshot of all connected providers
+func (r *Registry) Providers() []*Provider {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	providers := make([]*Provider, 0, len(r.providers))
+	for _, p := range r.providers {
+		providers = append(providers, p)
+	}
+	return providers
+}
+
+// Counts returns the number of connected clients and providers
+func (r *Registry) Counts() (clients int, providers int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.clients), len(r.providers)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ivynya/illm/internal"
+)
+
+// Clients and providers joining, leaving, identifying and being written to
+// all at once, meant to be run with -race
+func TestRegistryConcurrentUse(t *testing.T) {
+	r := NewRegistry()
+	const workers = 16
+	const rounds = 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				c, err := r.AddClient(&fakeSocket{}, "alice")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				c.Send([]byte(`{"action":"response"}`))
+				r.Client(c.Tag)
+				r.RemoveClient(c.Tag)
+			}
+		}()
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				p, err := r.AddProvider(&fakeSocket{}, "provider")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				r.Identify(p, &internal.Handshake{
+					Identifier: fmt.Sprint("box", w),
+					Models:     []string{"llama3", fmt.Sprint("model", i%3)},
+				})
+				p.Send([]byte(`{"action":"generate"}`))
+				r.Identify(p, &internal.Handshake{Identifier: fmt.Sprint("box", w), Models: []string{"mistral"}})
+				r.RemoveProvider(p.Tag)
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				for _, p := range r.ProvidersFor("llama3") {
+					p.Send([]byte(`{"action":"cancel"}`))
+					p.Models()
+				}
+				for _, c := range r.Clients() {
+					c.Send([]byte(`{"action":"response"}`))
+				}
+				r.Models()
+				r.Counts()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if clients, providers := r.Counts(); clients != 0 || providers != 0 {
+		t.Fatalf("%d clients and %d providers left after all were removed", clients, providers)
+	}
+	if models := r.Models(); len(models) != 0 {
+		t.Fatalf("models %v still indexed after every provider left", models)
+	}
+}
+
+func TestRegistryIndexesModels(t *testing.T) {
+	r := NewRegistry()
+	a, _ := r.AddProvider(&fakeSocket{}, "provider")
+	b, _ := r.AddProvider(&fakeSocket{}, "provider")
+	r.Identify(a, &internal.Handshake{Identifier: "a", Models: []string{"llama3:latest", "mistral"}})
+	r.Identify(b, &internal.Handshake{Identifier: "b", Models: []string{"llama3"}})
+
+	if got := len(r.ProvidersFor("llama3")); got != 2 {
+		t.Fatalf("llama3 has %d providers, want 2", got)
+	}
+	// A second handshake replaces what the provider serves
+	r.Identify(a, &internal.Handshake{Identifier: "a", Models: []string{"mistral"}})
+	if got := r.ProvidersFor("llama3"); len(got) != 1 || got[0] != b {
+		t.Fatalf("llama3 providers after a re-handshake: %v", got)
+	}
+	r.RemoveProvider(a.Tag)
+	if got := r.ProvidersFor("mistral"); len(got) != 0 {
+		t.Fatalf("mistral still served by %d providers after its only one left", len(got))
+	}
+}
+
+// Messages are written in order by the connection's writer, and nothing
+// is written after it is removed
+func TestConnWritesInOrder(t *testing.T) {
+	r := NewRegistry()
+	ws := &fakeSocket{}
+	c, _ := r.AddClient(ws, "alice")
+	for i := 0; i < 10; i++ {
+		c.Send([]byte(fmt.Sprintf(`{"action":"response","id":"%d"}`, i)))
+	}
+	for i, res := range ws.waitFor(t, "response", 10) {
+		if res.ID != fmt.Sprint(i) {
+			t.Fatalf("message %d has ID %s", i, res.ID)
+		}
+	}
+
+	r.RemoveClient(c.Tag)
+	if !ws.isClosed() {
+		t.Fatal("socket not closed when the client was removed")
+	}
+	if err := c.Send([]byte(`{}`)); err != errConnClosed {
+		t.Fatalf("send after removal: got %v, want errConnClosed", err)
+	}
+}
+
+// A connection that can't be written to is closed, not left to fill up
+func TestConnClosedOnWriteError(t *testing.T) {
+	r := NewRegistry()
+	ws := &fakeSocket{fail: true}
+	c, _ := r.AddClient(ws, "alice")
+	c.Send([]byte(`{}`))
+	eventually(t, ws.isClosed, "the socket to be closed")
+}
+
+// Hearing from a peer after its connection was closed doesn't undo the
+// past read deadline that ends the handler's read loop
+func TestCloseEndsReadLoop(t *testing.T) {
+	ws := &deadlineSocket{}
+	c := newConn("tag", "client", ws)
+	c.alive()
+	if !ws.deadline().After(time.Now()) {
+		t.Fatal("alive didn't push back the read deadline")
+	}
+
+	c.Close()
+	c.alive()
+	if ws.deadline().After(time.Now()) {
+		t.Fatalf("read deadline pushed back to %s after Close", ws.deadline())
+	}
+}
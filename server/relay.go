@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivynya/illm/internal"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+)
+
+// Relay handles requests from clients and messages from providers the same
+// way whichever endpoint they arrived on
+type Relay struct {
+	registry   *Registry
+	dispatcher *Dispatcher
+	limiter    *Limiter
+
+	mu         sync.RWMutex
+	imageLimit int
+	allowed    map[string]bool // users providers may authenticate as, nil for any
+}
+
+// prefix of the IDs the relay gives requests sent without one, so
+// overlapping requests can still be told apart. Clients never see them,
+// and may not send IDs starting with it.
+const anonymousPrefix = "~"
+
+// actions that stream responses until a done frame or an error
+var streamingActions = map[string]bool{
+	"generate":          true,
+	"chat":              true,
+	"embed":             true,
+	"summarize-youtube": true,
+}
+
+// configure the image limit and the provider allow-list, empty to allow
+// any provider. Connected providers the new list leaves out are dropped.
+func (r *Relay) configure(imageLimit int, allowlist []string) {
+	var allowed map[string]bool
+	if len(allowlist) > 0 {
+		allowed = make(map[string]bool)
+		for _, user := range allowlist {
+			allowed[user] = true
+		}
+	}
+	r.mu.Lock()
+	r.imageLimit, r.allowed = imageLimit, allowed
+	r.mu.Unlock()
+
+	for _, p := range r.registry.Providers() {
+		r.allowProvider(p)
+	}
+}
+
+func (r *Relay) maxImageBytes() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.imageLimit
+}
+
+// whether a provider that authenticated as user may join
+func (r *Relay) allows(user string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.allowed == nil || r.allowed[user]
+}
+
+// allowProvider checks a provider against the allow-list by who it
+// authenticated as, since the identifier in its handshake is whatever it
+// says it is. A provider that isn't allowed is told so and disconnected.
+func (r *Relay) allowProvider(provider *Provider) bool {
+	if r.allows(provider.User) {
+		return true
+	}
+	fmt.Println("Provider", provider.User, "is not on the allow-list")
+	data, _ := json.Marshal(internal.NewError(&internal.Request{}, internal.ErrProviderNotAllowed, "Provider "+provider.User+" is not allowed"))
+	provider.Send(data)
+	provider.Shutdown()
+	return false
+}
+
+// fromClient routes a request a client sent, already tagged with its tag
+func (r *Relay) fromClient(req *internal.Request) {
+	// If action is identify, broadcast to all providers
+	if req.Action == "identify" {
+		broadcastToProviders(r.registry, req)
+		return
+	}
+
+	// List provider keys, for sealing requests end-to-end
+	if req.Action == "keys" {
+		r.sendKeys(req)
+		return
+	}
+
+	// Cancel a queued or running request by its ID
+	if req.Action == "cancel" {
+		r.dispatcher.Cancel(req)
+		return
+	}
+
+	if streamingActions[req.Action] {
+		// Give requests without an ID one of their own
+		if req.ID == "" {
+			req.ID = anonymousID()
+		} else if strings.HasPrefix(req.ID, anonymousPrefix) {
+			sendToClient(r.registry, internal.NewError(req, internal.ErrInvalidRequest, "IDs starting with "+anonymousPrefix+" are reserved"))
+			return
+		}
+
+		// Count the request against its user's limits, refusing one whose
+		// ID is still running
+		err := r.limiter.Admit(req.User, req.Key())
+		if errors.Is(err, errDuplicateRequest) {
+			sendToClient(r.registry, internal.NewError(req, internal.ErrInvalidRequest, err.Error()))
+			return
+		}
+
+		// Measure requests from here on, however they end
+		trackRequest(r.registry, req)
+		var limit *limitError
+		if errors.As(err, &limit) {
+			res := internal.NewError(req, internal.ErrRateLimited, limit.Error())
+			res.Error.RetryAfter = limit.seconds()
+			broadcastToClient(r.registry, res)
+			return
+		}
+	}
+
+	// Reject images over the size limit before they reach a provider
+	if err := checkImages(req, r.maxImageBytes()); err != nil {
+		r.limiter.Release(req.Key())
+		broadcastToClient(r.registry, internal.NewError(req, internal.ErrImageTooLarge, err.Error()))
+		return
+	}
+
+	// Send request to provider, or queue it if they're all busy. The
+	// dispatcher tells the client itself if it can't.
+	err := r.dispatcher.Dispatch(req)
+	if err != nil {
+		log.Println("Relay to client error:", err)
+	}
+}
+
+// a unique ID for a request sent without one
+func anonymousID() string {
+	id, err := gonanoid.New()
+	if err != nil {
+		id = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return anonymousPrefix + id
+}
+
+// the keys of the providers serving model, or of every provider if it is
+// empty
+func (r *Relay) providerKeys(model string) []internal.ProviderKey {
+	providers := r.registry.Providers()
+	if model != "" {
+		providers = r.registry.ProvidersFor(model)
+	}
+	keys := []internal.ProviderKey{}
+	for _, p := range providers {
+		if key, ok := p.Key(); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// reply with the keys of the providers serving the request's model
+func (r *Relay) sendKeys(req *internal.Request) {
+	data, _ := json.Marshal(r.providerKeys(req.Generate.Model))
+	broadcastToClient(r.registry, &internal.Request{
+		Tag:    req.Tag,
+		ID:     req.ID,
+		Action: "keys",
+		Data:   string(data),
+	})
+}
+
+// clientLeft forgets a client and stops everything it was waiting on
+func (r *Relay) clientLeft(client *Conn) {
+	r.dispatcher.RemoveClient(client.Tag)
+	r.registry.RemoveClient(client.Tag)
+	untrackClient(client.Tag)
+}
+
+// fromProvider handles a message a provider sent
+func (r *Relay) fromProvider(provider *Provider, req *internal.Request) {
+	// Handshake advertises the provider's identifier and models
+	if req.Action == "handshake" && req.Handshake != nil {
+		// A provider that was refused may get a handshake in before it
+		// is disconnected
+		if !r.allows(provider.User) {
+			return
+		}
+		r.registry.Identify(provider, req.Handshake)
+		r.dispatcher.Joined(provider)
+		fmt.Println("Provider", req.Handshake.Identifier, "serving", len(req.Handshake.Models), "models")
+		return
+	}
+
+	// Heartbeats report load and aren't meant for anyone else. Older
+	// providers send pings instead, which only prove they're alive.
+	switch req.Action {
+	case "heartbeat":
+		if req.Heartbeat != nil {
+			provider.heartbeat(req.Heartbeat)
+		}
+		return
+	case "ping":
+		return
+	}
+
+	// No tag means won't be sent to any client
+	if req.Tag == "" {
+		return
+	}
+
+	// Identify replies only ever carry the identifier the provider
+	// advertised, so it can't pass itself off as another
+	if req.Action == "identify" {
+		broadcastToClient(r.registry, &internal.Request{
+			Tag:    req.Tag,
+			ID:     req.ID,
+			Action: "identify",
+			Data:   provider.Identifier(),
+		})
+		return
+	}
+
+	// Anything else must be about a request the provider is running, so
+	// it can't answer other providers' requests or keep writing to
+	// clients once its own have ended
+	if !r.dispatcher.Running(provider, req.Key()) {
+		return
+	}
+
+	// Track when the provider finishes a request and how fast it was,
+	// and charge users for what was generated even if it stops early
+	switch req.Action {
+	case "response":
+		if stats, ok := responseStatsOf(req); ok {
+			if r.dispatcher.Finished(provider, req) {
+				provider.observe(stats)
+				observeProvider(provider, stats)
+				r.limiter.Finish(req.Key(), stats.PromptEvalCount+stats.EvalCount)
+			}
+		} else {
+			r.limiter.Progress(req.Key())
+		}
+	case "error":
+		if r.dispatcher.Finished(provider, req) {
+			r.limiter.Release(req.Key())
+		}
+	}
+
+	// Relay message to client with matching tag
+	err := broadcastToClient(r.registry, req)
+	if err != nil {
+		log.Println("Relay to client error:", err)
+	}
+}
+
+// providerLeft forgets a provider and fails what it was running
+func (r *Relay) providerLeft(provider *Provider) {
+	r.registry.RemoveProvider(provider.Tag)
+	r.dispatcher.Left(provider)
+}
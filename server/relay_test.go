@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ivynya/illm/internal"
+)
+
+// The allow-list is checked against who a provider authenticated as, not
+// the identifier it claims
+func TestAllowlistChecksAuthenticatedUser(t *testing.T) {
+	r := newTestRelay(Limits{})
+	r.configure(defaultMaxImageBytes, []string{"box"})
+
+	ws := &fakeSocket{}
+	impostor, _ := r.registry.AddProvider(ws, "mallory")
+	if r.allowProvider(impostor) {
+		t.Fatal("provider authenticated as mallory was allowed")
+	}
+	refused := ws.waitFor(t, "error", 1)[0]
+	if refused.Error.Code != internal.ErrProviderNotAllowed {
+		t.Fatalf("got %+v, want provider_not_allowed", refused.Error)
+	}
+	eventually(t, ws.isClosed, "the refused provider to be disconnected")
+
+	// Claiming an allowed identifier in the handshake doesn't get it models
+	r.fromProvider(impostor, &internal.Request{
+		Action:    "handshake",
+		Handshake: &internal.Handshake{Identifier: "box", Models: []string{"llama3"}},
+	})
+	if got := r.registry.ProvidersFor("llama3"); len(got) != 0 {
+		t.Fatal("refused provider was routed requests")
+	}
+
+	allowed, _ := r.registry.AddProvider(&fakeSocket{}, "box")
+	if !r.allowProvider(allowed) {
+		t.Fatal("provider authenticated as box was refused")
+	}
+}
+
+// A reload that takes a provider off the allow-list disconnects it
+func TestReloadDropsProvidersNoLongerAllowed(t *testing.T) {
+	r := newTestRelay(Limits{})
+	p, ws := addTestProvider(t, r, "box", 1, "llama3")
+	other, otherWS := addTestProvider(t, r, "other", 1, "llama3")
+
+	r.configure(defaultMaxImageBytes, []string{"someone-else"})
+	eventually(t, ws.isClosed, "the provider to be disconnected")
+	eventually(t, otherWS.isClosed, "the other provider to be disconnected")
+	if refused := ws.waitFor(t, "error", 1)[0]; refused.Error.Code != internal.ErrProviderNotAllowed {
+		t.Fatalf("got %+v, want provider_not_allowed", refused.Error)
+	}
+	// as their handlers do when the closed sockets end their read loops
+	r.providerLeft(p)
+	r.providerLeft(other)
+
+	r.configure(defaultMaxImageBytes, []string{"provider"})
+	_, keptWS := addTestProvider(t, r, "box", 1, "llama3")
+	r.configure(defaultMaxImageBytes, []string{"provider", "box"})
+	if keptWS.isClosed() || len(r.registry.ProvidersFor("llama3")) != 1 {
+		t.Fatal("provider still on the allow-list was dropped")
+	}
+}
+
+// Providers can only write to clients about requests they are running
+func TestProvidersCannotInjectResponses(t *testing.T) {
+	r := newTestRelay(Limits{})
+	client, clientWS := addTestClient(t, r, "alice")
+	provider, providerWS := addTestProvider(t, r, "box", 1, "llama3")
+	other, _ := addTestProvider(t, r, "other", 1, "mistral")
+
+	r.fromClient(testGenerate(client, "1", "llama3"))
+	req := providerWS.waitFor(t, "generate", 1)[0]
+	r.fromProvider(other, testResponse(req, false, 0))
+	r.fromProvider(provider, testResponse(req, true, 5))
+	clientWS.waitFor(t, "response", 1)
+
+	// Once it has ended, not even the provider that ran it can add to it
+	for _, action := range []string{"response", "error", "queued"} {
+		r.fromProvider(provider, &internal.Request{Tag: req.Tag, ID: req.ID, Action: action, Data: "injected"})
+	}
+	r.fromProvider(provider, &internal.Request{Tag: req.Tag, ID: "2", Action: "response", Data: "injected"})
+
+	// Identify replies go through, but only with the provider's own name
+	r.fromProvider(other, &internal.Request{Tag: req.Tag, Action: "identify", Data: "box"})
+	identified := clientWS.waitFor(t, "identify", 1)[0]
+	if identified.Data != "other" {
+		t.Fatalf("provider identified itself as %q, want other", identified.Data)
+	}
+	for _, res := range clientWS.requests() {
+		if res.Data == "injected" || res.Action == "error" || res.Action == "queued" {
+			t.Fatalf("client was sent %s %q", res.Action, res.Data)
+		}
+	}
+	if n := len(clientWS.waitFor(t, "response", 1)); n != 1 {
+		t.Fatalf("client was sent %d responses, want 1", n)
+	}
+}
@@ -2,47 +2,109 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/basicauth"
 	"github.com/gofiber/websocket/v2"
 	"github.com/ivynya/illm/internal"
-	gonanoid "github.com/matoous/go-nanoid/v2"
 )
 
-var (
-	username = os.Getenv("USERNAME")
-	password = os.Getenv("PASSWORD")
-)
+// queued requests allowed per model by default
+const defaultMaxQueueDepth = 32
 
 func main() {
-	clients := make(map[string]*websocket.Conn)
-	providers := make(map[string]*websocket.Conn)
+	// Read the config file, environment and flags, and refuse to start
+	// with a config that isn't right
+	loader := newLoader()
+	args, err := loader.Parse("server", os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+	cfg, err := loadConfig(loader)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	users, err := LoadUsers(cfg.UsersFile)
+	if err != nil {
+		log.Fatal("users_file: ", err)
+	}
+	if len(args) > 0 && args[0] == "keys" {
+		if err := runKeys(users, args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		os.Exit(2)
+	}
+
+	registry := NewRegistry()
+	balancer, _ := newBalancer(cfg.Balancer)
+	dispatcher := NewDispatcher(registry, balancer, cfg.MaxQueueDepth)
+	limiter := NewLimiter(cfg.RateLimits)
+	dispatcher.ended = func(req *internal.Request) {
+		limiter.Release(req.Key())
+	}
+	relay := &Relay{
+		registry:   registry,
+		dispatcher: dispatcher,
+		limiter:    limiter,
+	}
+	relay.configure(cfg.MaxImageBytes, cfg.ProviderAllowlist)
+	setAdmin(cfg.Username, cfg.Password)
+
+	// Apply changes to the config file without dropping anyone connected
+	go watchConfig(loader, cfg, func(previous *Config, c *Config) {
+		c.apply(previous, users, dispatcher, limiter, relay)
+	})
 
 	app := fiber.New()
-	app.Use(basicauth.New(basicauth.Config{
-		Users: map[string]string{
-			username: password,
-		},
-	}))
+	// Every endpoint needs a login, and a role that may use it
+	app.Use(authenticate(users))
+	app.Use("/aura/provider", requireRole(roleProvider), requireClientCert)
+	app.Use("/aura/client", requireRole(roleClient))
+	app.Use("/v1", requireRole(roleClient))
+	app.Use("/api", requireRole(roleClient))
+	adminRoutes(app, users)
 
 	// Provider websocket endpoint
 	app.Get("/aura/provider", websocket.New(func(c *websocket.Conn) {
 		// Register new provider and give it a random tag
-		tag, err := gonanoid.New()
+		user := identityOf(c.Locals("identity")).User
+		provider, err := registry.AddProvider(c, user)
 		if err != nil {
-			log.Fatal(err)
+			log.Println("Register error:", err)
+			return
 		}
-		providers[tag] = c
 
 		// Log join message
-		fmt.Println("Provider joined from " + c.RemoteAddr().String())
-		fmt.Println("Total providers:", len(providers))
-		broadcastConnectionStats(clients, providers)
+		_, total := registry.Counts()
+		fmt.Println("Provider joined from " + c.RemoteAddr().String() + " as " + user)
+		fmt.Println("Total providers:", total)
+		broadcastConnectionStats(registry)
+
+		// Refuse providers not on the allow-list, once the writer has
+		// told them why
+		if !relay.allowProvider(provider) {
+			<-provider.stopped
+			relay.providerLeft(provider)
+			broadcastConnectionStats(registry)
+			return
+		}
 
+		// Drop the provider if it goes silent
+		watch(c, provider.Conn)
 		for {
 			// Read message from provider
 			_, msg, err := c.ReadMessage()
@@ -50,6 +112,7 @@ func main() {
 				log.Println("Websocket read error:", err)
 				break
 			}
+			provider.alive()
 
 			// Decode message into request struct
 			req := &internal.Request{}
@@ -59,39 +122,32 @@ func main() {
 				break
 			}
 
-			// No tag means won't be sent to any client
-			if req.Tag == "" {
-				continue
-			}
-
-			// Relay message to client with matching tag
-			err = broadcastToClient(clients, req)
-			if err != nil {
-				log.Println("Websocket write error:", err)
-				// Delete client if it is no longer connected
-				delete(clients, req.Tag)
-			}
+			relay.fromProvider(provider, req)
 		}
 
 		// Unregister provider
-		delete(providers, tag)
-		broadcastConnectionStats(clients, providers)
+		relay.providerLeft(provider)
+		broadcastConnectionStats(registry)
 	}))
 
 	// WebSocket endpoint
 	app.Get("/aura/client", websocket.New(func(c *websocket.Conn) {
 		// Register new client and give it a random tag
-		tag, err := gonanoid.New()
+		user := identityOf(c.Locals("identity")).User
+		client, err := registry.AddClient(c, user)
 		if err != nil {
-			log.Fatal(err)
+			log.Println("Register error:", err)
+			return
 		}
-		clients[tag] = c
 
 		// Log join message and broadcast counts
-		fmt.Println("Client joined from " + c.RemoteAddr().String())
-		fmt.Println("Total clients:", len(clients))
-		broadcastConnectionStats(clients, providers)
+		total, _ := registry.Counts()
+		fmt.Println("Client joined from " + c.RemoteAddr().String() + " as " + user)
+		fmt.Println("Total clients:", total)
+		broadcastConnectionStats(registry)
 
+		// Drop the client if it goes silent
+		watch(c, client)
 		for {
 			// Read message from client
 			_, msg, err := c.ReadMessage()
@@ -99,6 +155,7 @@ func main() {
 				log.Println("Websocket read error:", err)
 				break
 			}
+			client.alive()
 
 			// Decode message into request struct
 			req := &internal.Request{}
@@ -108,31 +165,34 @@ func main() {
 				break
 			}
 
-			// Tag request with client tag
-			req.Tag = tag
+			// Tag request with client tag and user
+			tagRequest(client, req)
 
-			// If action is identify, broadcast to all providers
-			if req.Action == "identify" {
-				broadcastAll(providers, req)
-				continue
-			}
-
-			// Send request to provider
-			err = broadcastToProvider(providers, req)
-			if err != nil {
-				log.Println("Websocket write error:", err)
-				// Delete provider if it is no longer connected
-				delete(providers, req.Tag)
-				// Send error message to client
-				c.WriteMessage(websocket.TextMessage, []byte(`{"action":"error","data":"Provider disconnected"}`))
-			}
+			relay.fromClient(req)
 		}
 
 		// Unregister client
-		delete(clients, tag)
-		broadcastConnectionStats(clients, providers)
+		relay.clientLeft(client)
+		broadcastConnectionStats(registry)
 	}))
 
-	// Start the server
-	log.Fatal(app.Listen(":3000"))
+	// Server-sent events endpoint for clients that can't use websockets
+	app.Post("/aura/client/sse", relay.sseClient)
+	app.Get("/aura/client/keys", relay.sseKeys)
+
+	// OpenAI-compatible HTTP API
+	relay.openAIRoutes(app)
+
+	// Ollama-compatible HTTP API
+	relay.ollamaRoutes(app)
+
+	// Prometheus metrics
+	metricsRoutes(app, registry, dispatcher)
+
+	// Start the server, with TLS if it is configured
+	config, err := tlsConfig(cfg.TLS)
+	if err != nil {
+		log.Fatal("tls: ", err)
+	}
+	log.Fatal(listen(app, cfg.Listen, config))
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ivynya/illm/internal"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+)
+
+// chanSocket stands in for a websocket when a client is connected over
+// plain HTTP. Messages written to it are delivered on frames until it is
+// closed.
+type chanSocket struct {
+	frames chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newChanSocket() *chanSocket {
+	return &chanSocket{
+		frames: make(chan []byte),
+		closed: make(chan struct{}),
+	}
+}
+
+func (s *chanSocket) WriteMessage(messageType int, data []byte) error {
+	select {
+	case s.frames <- data:
+		return nil
+	case <-s.closed:
+		return errConnClosed
+	}
+}
+
+func (s *chanSocket) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+// relayError is an error action received in place of a response
+type relayError struct {
+	Code       string
+	Message    string
+	RetryAfter int // seconds, for rate_limited errors
+}
+
+func (e *relayError) Error() string {
+	return e.Message
+}
+
+// session is an HTTP request acting as a relay client for the length of
+// one relayed request
+type session struct {
+	relay  *Relay
+	client *Conn
+	socket *chanSocket
+	id     string
+	once   sync.Once
+}
+
+// open a session registered with the relay like any other client
+func (r *Relay) openSession(user string) (*session, error) {
+	socket := newChanSocket()
+	client, err := r.registry.AddClient(socket, user)
+	if err != nil {
+		return nil, err
+	}
+	id, err := gonanoid.New()
+	if err != nil {
+		r.clientLeft(client)
+		return nil, err
+	}
+	return &session{relay: r, client: client, socket: socket, id: id}, nil
+}
+
+// send tags the request as the session's and routes it
+func (s *session) send(req *internal.Request) {
+	tagRequest(s.client, req)
+	req.ID = s.id
+	s.relay.fromClient(req)
+}
+
+// frame returns the next message the relay sends about the session's
+// request, skipping everything else it sends clients
+func (s *session) frame() (*internal.Request, error) {
+	for {
+		select {
+		case frame := <-s.socket.frames:
+			res := &internal.Request{}
+			if err := json.Unmarshal(frame, res); err != nil || res.ID != s.id {
+				continue
+			}
+			return res, nil
+		case <-s.socket.closed:
+			return nil, errConnClosed
+		}
+	}
+}
+
+// next returns the data of the next response to the session's request.
+// An error action is returned as a *relayError and queue updates are
+// skipped.
+func (s *session) next() (string, error) {
+	for {
+		res, err := s.frame()
+		if err != nil {
+			return "", err
+		}
+		switch res.Action {
+		case "response":
+			return res.Data, nil
+		case "error":
+			err := &relayError{Message: res.Data}
+			if res.Error != nil {
+				err.Code, err.Message, err.RetryAfter = res.Error.Code, res.Error.Message, res.Error.RetryAfter
+			}
+			return "", err
+		}
+	}
+}
+
+// close the session, cancelling its request if it is still running. Safe
+// to call repeatedly.
+func (s *session) close() {
+	s.once.Do(func() {
+		s.relay.clientLeft(s.client)
+	})
+}
+
+// watch closes the session if the HTTP client hangs up while the handler
+// waits on the relay, which nothing else would notice until it wrote the
+// response. Nothing reads the connection while the handler runs, so a
+// read only returns when the client closes it. The returned func stops
+// watching, and must be called before the handler returns so fasthttp
+// can read the next request.
+func (s *session) watch(c *fiber.Ctx) func() {
+	conn := c.Context().Conn()
+	conn.SetReadDeadline(time.Time{})
+	stopping := make(chan struct{})
+	stopped := make(chan struct{})
+	early := false // the client sent its next request before this one ended
+	go func() {
+		defer close(stopped)
+		n, _ := conn.Read(make([]byte, 1))
+		select {
+		case <-stopping:
+		default:
+			if n == 0 {
+				s.close()
+			}
+		}
+		early = n > 0
+	}()
+
+	return func() {
+		close(stopping)
+		conn.SetReadDeadline(time.Now())
+		<-stopped
+		conn.SetReadDeadline(time.Time{})
+		// the byte read can't be given back to fasthttp, so the client
+		// has to send it again on a new connection
+		if early {
+			c.Context().SetConnectionClose()
+		}
+	}
+}
+
+// pass a rate limit's retry after on as the Retry-After header
+func setRetryAfter(c *fiber.Ctx, err *relayError) {
+	if err.RetryAfter > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(err.RetryAfter))
+	}
+}
+
+// HTTP status for an error code received from the relay or a provider
+func httpStatus(code string) int {
+	switch code {
+	case internal.ErrInvalidRequest, internal.ErrModelNotMultimodal:
+		return http.StatusBadRequest
+	case internal.ErrModelUnavailable, internal.ErrModelNotFound:
+		return http.StatusNotFound
+	case internal.ErrImageTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case internal.ErrRateLimited:
+		return http.StatusTooManyRequests
+	case internal.ErrQueueFull, internal.ErrProviderUnavailable:
+		return http.StatusServiceUnavailable
+	case internal.ErrOllamaUnreachable:
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
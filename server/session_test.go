@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// HTTP clients that hang up while waiting for a whole response, or for a
+// stream to start, have their request cancelled
+func TestHTTPClientHangupCancelsRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		action string
+		body   string
+	}{
+		{"openai", "/v1/chat/completions", "chat", `{"model":"llama3","messages":[{"role":"user","content":"hello"}]}`},
+		{"openai stream", "/v1/completions", "generate", `{"model":"llama3","prompt":"hello","stream":true}`},
+		{"ollama", "/api/generate", "generate", `{"model":"llama3","prompt":"hello","stream":false}`},
+		{"ollama stream", "/api/chat", "chat", `{"model":"llama3","messages":[{"role":"user","content":"hello"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRelay(Limits{})
+			_, providerWS := addTestProvider(t, r, "box", 1, "llama3")
+			addr := strings.TrimPrefix(serveHTTP(t, r), "http://")
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(conn, "POST "+tt.path+" HTTP/1.1\r\nHost: relay\r\nContent-Type: application/json\r\n"+
+				"Content-Length: "+strconv.Itoa(len(tt.body))+"\r\n\r\n"+tt.body)
+			req := providerWS.waitFor(t, tt.action, 1)[0]
+			conn.Close()
+
+			cancel := providerWS.waitFor(t, "cancel", 1)[0]
+			if cancel.Tag != req.Tag || cancel.ID != req.ID {
+				t.Fatalf("cancelled %s, want %s", cancel.Key(), req.Key())
+			}
+		})
+	}
+}
+
+// Watching for a hangup leaves the connection usable for the next request
+func TestHTTPClientKeepAlive(t *testing.T) {
+	r := newTestRelay(Limits{})
+	provider, providerWS := addTestProvider(t, r, "box", 1, "llama3")
+	url := serveHTTP(t, r) + "/v1/completions"
+
+	for i := 1; i <= 2; i++ {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			req := providerWS.waitFor(t, "generate", i)[i-1]
+			r.fromProvider(provider, testResponse(req, true, 5))
+		}()
+		res, err := http.Post(url, "application/json", strings.NewReader(`{"model":"llama3","prompt":"hello"}`))
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, res.StatusCode)
+		}
+		<-done
+	}
+	for _, req := range providerWS.requests() {
+		if req.Action == "cancel" {
+			t.Fatalf("request %s was cancelled", req.Key())
+		}
+	}
+}
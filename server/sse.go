@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ivynya/illm/internal"
+	"github.com/valyala/fasthttp"
+)
+
+// how often an idle stream is written to, to find clients that left
+const sseKeepalive = time.Second * 15
+
+// Provider keys for sealing requests sent here, as the keys action lists
+// them on websockets
+func (r *Relay) sseKeys(c *fiber.Ctx) error {
+	return c.JSON(r.providerKeys(c.Query("model")))
+}
+
+// Client endpoint for networks that break websockets. The body is one
+// request like those sent on /aura/client, and every frame the relay sends
+// about it comes back as a server-sent event until the request is done or
+// fails. Disconnecting cancels the request.
+func (r *Relay) sseClient(c *fiber.Ctx) error {
+	req := &internal.Request{}
+	if err := json.Unmarshal(c.Body(), req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(internal.NewError(req, internal.ErrInvalidRequest, err.Error()))
+	}
+	if !streamingActions[req.Action] {
+		return c.Status(fiber.StatusBadRequest).JSON(internal.NewError(req, internal.ErrInvalidRequest, "Unknown action "+req.Action))
+	}
+	// the relay's error would lose the ID and never match the stream
+	if strings.HasPrefix(req.ID, anonymousPrefix) {
+		return c.Status(fiber.StatusBadRequest).JSON(internal.NewError(req, internal.ErrInvalidRequest, "IDs starting with "+anonymousPrefix+" are reserved"))
+	}
+
+	s, err := r.openSession(identityOf(c.Locals("identity")).User)
+	if err != nil {
+		return err
+	}
+	// keep the client's own request id so frames match what it sent
+	if req.ID != "" {
+		s.id = req.ID
+	}
+	s.send(req)
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	frames := make(chan *internal.Request)
+	go func() {
+		defer close(frames)
+		for {
+			res, err := s.frame()
+			if err != nil {
+				return
+			}
+			select {
+			case frames <- res:
+			case <-s.socket.closed:
+				return
+			}
+		}
+	}()
+
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer s.close()
+		keepalive := time.NewTicker(sseKeepalive)
+		defer keepalive.Stop()
+		for {
+			var res *internal.Request
+			select {
+			case res = <-frames:
+				if res == nil {
+					return
+				}
+			case <-keepalive.C:
+				// notices a client that left while nothing was sent,
+				// such as a request waiting in a queue
+				fmt.Fprint(w, ": keepalive\n\n")
+				if w.Flush() != nil {
+					return
+				}
+				continue
+			}
+			if writeEvent(w, res) != nil {
+				return
+			}
+
+			// stop after the last frame of the request
+			if res.Action == "error" {
+				return
+			}
+			if stats, ok := responseStatsOf(res); ok && stats.Done {
+				return
+			}
+		}
+	}))
+	return nil
+}
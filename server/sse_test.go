@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ivynya/illm/internal"
+)
+
+// serve the HTTP client endpoints of r on a local port, for alice
+func serveHTTP(t *testing.T, r *Relay) string {
+	t.Helper()
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("identity", &identity{User: "alice", Role: roleClient})
+		return c.Next()
+	})
+	app.Post("/aura/client/sse", r.sseClient)
+	r.openAIRoutes(app)
+	r.ollamaRoutes(app)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+	return "http://" + ln.Addr().String()
+}
+
+// A client that aborts a stream part way has its request cancelled on the
+// provider, and is forgotten by the relay once the provider stops
+func TestSSEAbortCancelsRequest(t *testing.T) {
+	r := newTestRelay(Limits{})
+	provider, providerWS := addTestProvider(t, r, "box", 1, "llama3")
+	url := serveHTTP(t, r) + "/aura/client/sse"
+
+	// Headers only arrive with the first event
+	responses := make(chan *http.Response, 1)
+	go func() {
+		res, err := http.Post(url, "application/json", strings.NewReader(`{"action":"generate","id":"mine","generate":{"model":"llama3","prompt":"hello"}}`))
+		if err != nil {
+			t.Error(err)
+			close(responses)
+			return
+		}
+		responses <- res
+	}()
+	req := providerWS.waitFor(t, "generate", 1)[0]
+	if req.User != "alice" {
+		t.Fatalf("request sent for user %q, want alice", req.User)
+	}
+
+	// Read the first event, then hang up
+	r.fromProvider(provider, testResponse(req, false, 0))
+	res := <-responses
+	if res == nil {
+		t.FailNow()
+	}
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &internal.Request{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), event); err != nil || event.ID != "mine" {
+		t.Fatalf("first event %q, want a response for mine", line)
+	}
+	res.Body.Close()
+
+	// The relay notices when it next writes, as the provider streams on
+	eventually(t, func() bool {
+		r.fromProvider(provider, testResponse(req, false, 0))
+		return len(providerWS.requests()) > 1
+	}, "a cancel to reach the provider")
+	cancel := providerWS.waitFor(t, "cancel", 1)[0]
+	if cancel.Tag != req.Tag || cancel.ID != req.ID {
+		t.Fatalf("cancelled %s/%s, want %s", cancel.Tag, cancel.ID, req.Key())
+	}
+	eventually(t, func() bool {
+		clients, _ := r.registry.Counts()
+		return clients == 0
+	}, "the session to leave the registry")
+
+	// The provider confirms it stopped, which ends the request
+	stopped := &internal.Request{Tag: req.Tag, ID: req.ID, Action: "error"}
+	stopped.Error = &internal.Error{Code: internal.ErrCancelled, Message: "Cancelled"}
+	r.fromProvider(provider, stopped)
+
+	r.limiter.mu.Lock()
+	active := len(r.limiter.active)
+	r.limiter.mu.Unlock()
+	if active != 0 {
+		t.Fatalf("%d requests still admitted after the provider stopped", active)
+	}
+	if n := provider.Outstanding(); n != 0 {
+		t.Fatalf("provider still has %d requests outstanding", n)
+	}
+	if tokens := tokensUsed(r.limiter, "alice"); tokens == 0 {
+		t.Fatal("aborted request wasn't charged for what it streamed")
+	}
+}
+
+func TestSSERefusesReservedIDs(t *testing.T) {
+	r := newTestRelay(Limits{})
+	addTestProvider(t, r, "box", 1, "llama3")
+	url := serveHTTP(t, r) + "/aura/client/sse"
+
+	res, err := http.Post(url, "application/json", strings.NewReader(`{"action":"generate","id":"~mine","generate":{"model":"llama3","prompt":"hello"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	refused := &internal.Request{}
+	json.NewDecoder(res.Body).Decode(refused)
+	if res.StatusCode != http.StatusBadRequest || refused.Error == nil || refused.Error.Code != internal.ErrInvalidRequest {
+		t.Fatalf("got %d %+v, want 400 invalid_request", res.StatusCode, refused.Error)
+	}
+}
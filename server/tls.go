@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// where certificates from ACME are cached by default
+const defaultACMECache = "certs"
+
+// whether providers must present a client certificate, set at startup
+var mutualTLS bool
+
+// tlsConfig builds the server's TLS configuration, or returns nil to serve
+// plain HTTP. Certificates come from the cert and key files, or from an
+// ACME CA for the ACME domains. If a client CA is set, peers may present a
+// client certificate signed by it, which providers then must. The config
+// has been validated.
+func tlsConfig(t TLSConfig) (*tls.Config, error) {
+	var config *tls.Config
+	switch {
+	case t.Cert != "":
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	case len(t.ACME.Domains) > 0:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(t.ACME.Cache),
+			HostPolicy: autocert.HostWhitelist(t.ACME.Domains...),
+			Email:      t.ACME.Email,
+		}
+		// certificates are obtained with the TLS-ALPN-01 challenge on this
+		// same listener, so it must be reachable on port 443
+		config = &tls.Config{
+			GetCertificate: manager.GetCertificate,
+			NextProtos:     []string{"http/1.1", acme.ALPNProto},
+		}
+	default:
+		return nil, nil
+	}
+	config.MinVersion = tls.VersionTLS12
+
+	if t.ClientCA != "" {
+		pem, err := os.ReadFile(t.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("tls.client_ca: no certificates found")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		mutualTLS = true
+	}
+	return config, nil
+}
+
+// listen on addr, with TLS if config is set
+func listen(app *fiber.App, addr string, config *tls.Config) error {
+	if config == nil {
+		return app.Listen(addr)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return app.Listener(tls.NewListener(ln, config))
+}
+
+// the verified client certificate a request came with, or nil
+func clientCert(c *fiber.Ctx) *x509.Certificate {
+	state := c.Context().TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// requireClientCert rejects requests without a verified client
+// certificate, when mutual TLS is on
+func requireClientCert(c *fiber.Ctx) error {
+	if mutualTLS && clientCert(c) == nil {
+		return c.SendStatus(fiber.StatusForbidden)
+	}
+	return c.Next()
+}
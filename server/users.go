@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefix of every API key, so leaked keys are easy to recognise
+const keyPrefix = "illm_"
+
+var errKeyNotFound = errors.New("no such key")
+
+// APIKey is a stored API key. Only a hash of the key itself is kept.
+type APIKey struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Role    string    `json:"role"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+// Users is the store of API keys, kept in a JSON file. The file is
+// re-read when it changes, so keys created or revoked from the command
+// line apply to a running server.
+type Users struct {
+	mu       sync.Mutex
+	path     string
+	modified time.Time
+	keys     []*APIKey
+}
+
+func LoadUsers(path string) (*Users, error) {
+	u := &Users{path: path}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u, u.refresh()
+}
+
+// reload the file if it changed since it was last read. A missing file is
+// an empty store.
+func (u *Users) refresh() error {
+	info, err := os.Stat(u.path)
+	if errors.Is(err, os.ErrNotExist) {
+		u.keys, u.modified = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(u.modified) {
+		return nil
+	}
+
+	data, err := os.ReadFile(u.path)
+	if err != nil {
+		return err
+	}
+	keys := []*APIKey{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	u.keys, u.modified = keys, info.ModTime()
+	return nil
+}
+
+// SetPath switches to the store in another file
+func (u *Users) SetPath(path string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if path == u.path {
+		return nil
+	}
+	u.path, u.modified = path, time.Time{}
+	return u.refresh()
+}
+
+// write the store through a temporary file so readers never see half of it
+func (u *Users) save() error {
+	data, err := json.MarshalIndent(u.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := u.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, u.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(u.path); err == nil {
+		u.modified = info.ModTime()
+	}
+	return nil
+}
+
+// keys stored before roles existed are client keys
+func (k *APIKey) role() string {
+	if k.Role == "" {
+		return roleClient
+	}
+	return k.Role
+}
+
+// Create a key for the user with the given role. The key itself is only
+// ever returned here.
+func (u *Users) Create(user string, role string) (string, *APIKey, error) {
+	// the id is random too, so it gives nothing of the key away
+	secret := make([]byte, 28)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	token := keyPrefix + hex.EncodeToString(secret[4:])
+	key := &APIKey{
+		ID:      hex.EncodeToString(secret[:4]),
+		User:    user,
+		Role:    role,
+		Hash:    hashKey(token),
+		Created: time.Now().UTC(),
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.refresh(); err != nil {
+		return "", nil, err
+	}
+	u.keys = append(u.keys, key)
+	return token, key, u.save()
+}
+
+// Revoke the key with the given id
+func (u *Users) Revoke(id string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.refresh(); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(u.keys, func(k *APIKey) bool { return k.ID == id })
+	if i < 0 {
+		return errKeyNotFound
+	}
+	u.keys = slices.Delete(u.keys, i, i+1)
+	return u.save()
+}
+
+// List every key, without any way to recover the keys themselves
+func (u *Users) List() ([]APIKey, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.refresh(); err != nil {
+		return nil, err
+	}
+	keys := make([]APIKey, 0, len(u.keys))
+	for _, key := range u.keys {
+		keys = append(keys, *key)
+	}
+	return keys, nil
+}
+
+// Lookup the stored key matching a key presented by a client
+func (u *Users) Lookup(token string) (*APIKey, bool) {
+	if !strings.HasPrefix(token, keyPrefix) {
+		return nil, false
+	}
+	hash := hashKey(token)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.refresh(); err != nil {
+		return nil, false
+	}
+	for _, key := range u.keys {
+		if key.Hash == hash {
+			k := *key
+			return &k, true
+		}
+	}
+	return nil, false
+}
+
+// keys are long and random, so a fast hash is enough to keep them safe at
+// rest without slowing down every request
+func hashKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestUsers(t *testing.T) *Users {
+	t.Helper()
+	users, err := LoadUsers(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return users
+}
+
+// The store only ever has a hash of a key, which still looks it up
+func TestKeysStoredAsHashes(t *testing.T) {
+	users := newTestUsers(t)
+	token, key, err := users.Create("alice", roleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, keyPrefix) || strings.Contains(token, key.ID) {
+		t.Fatalf("key %q with id %q", token, key.ID)
+	}
+
+	data, err := os.ReadFile(users.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), strings.TrimPrefix(token, keyPrefix)) {
+		t.Fatalf("key stored in the clear: %s", data)
+	}
+	if !strings.Contains(string(data), hashKey(token)) {
+		t.Fatalf("hash of the key not stored: %s", data)
+	}
+
+	found, ok := users.Lookup(token)
+	if !ok || found.User != "alice" || found.ID != key.ID {
+		t.Fatalf("looked up %+v, want alice's key", found)
+	}
+	for _, token := range []string{"", keyPrefix, hashKey(token), strings.TrimPrefix(token, keyPrefix)} {
+		if _, ok := users.Lookup(token); ok {
+			t.Errorf("looked up a key with %q", token)
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	users := newTestUsers(t)
+	revoked, key, _ := users.Create("alice", roleClient)
+	kept, _, _ := users.Create("bob", roleProvider)
+
+	if err := users.Revoke(key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Revoke(key.ID); !errors.Is(err, errKeyNotFound) {
+		t.Fatalf("revoked twice: got %v, want errKeyNotFound", err)
+	}
+
+	// Another process reading the file sees the same keys
+	reloaded, err := LoadUsers(users.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []*Users{users, reloaded} {
+		if _, ok := u.Lookup(revoked); ok {
+			t.Error("revoked key still works")
+		}
+		if found, ok := u.Lookup(kept); !ok || found.User != "bob" {
+			t.Error("other key was revoked too")
+		}
+	}
+	if keys, _ := reloaded.List(); len(keys) != 1 {
+		t.Fatalf("%d keys listed, want 1", len(keys))
+	}
+}
+
+// Keys stored before roles existed are client keys
+func TestKeysWithoutRoleAreClients(t *testing.T) {
+	users := newTestUsers(t)
+	token := keyPrefix + "0123456789abcdef"
+	data := `[{"id":"0001","user":"alice","hash":"` + hashKey(token) + `","created":"2024-01-01T00:00:00Z"}]`
+	if err := os.WriteFile(users.path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	id, ok := authorize(users, "Bearer "+token)
+	if !ok || id.User != "alice" || id.Role != roleClient {
+		t.Fatalf("got %+v, want alice as a client", id)
+	}
+}